@@ -6,19 +6,42 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/chappjc/webfiles/middleware"
 	"github.com/chappjc/webfiles/response"
 	"github.com/chappjc/webfiles/server"
+	"github.com/chappjc/webfiles/storage"
 )
 
 var listen = flag.String("host", "127.0.0.1:7777", "webfiles listens on host:port")
 var signingKey = flag.String("signingkey", "asdf1234", "Signing key for JWT and sessions.")
 var maxFileSize = flag.Int64("maxfilesize", 32<<22, "Maximum uploaded file size permitted.")
 var logLevel = flag.String("loglevel", "debug", "Logging level (debug, info, warning, error, fatal, panic)")
+var hideFiles = flag.Bool("hidefiles", false, "Respond 404 Not Found instead of 403 Forbidden when a user requests another user's file")
+var trashRetention = flag.Duration("trashretention", 30*24*time.Hour, "How long deleted files are kept in the trash (0 to delete immediately)")
+var storageType = flag.String("storage", "disk", "Storage backend for uploaded files (disk, s3)")
+var s3Endpoint = flag.String("s3endpoint", "s3.amazonaws.com", "S3-compatible object storage host[:port]")
+var s3Bucket = flag.String("s3bucket", "webfiles", "S3 bucket for uploaded files")
+var s3AccessKey = flag.String("s3accesskey", "", "S3 access key ID")
+var s3SecretKey = flag.String("s3secretkey", "", "S3 secret access key")
+var s3Region = flag.String("s3region", "", "S3 region (optional)")
+var s3Prefix = flag.String("s3prefix", "", "Prefix for S3 object keys")
+var s3Secure = flag.Bool("s3secure", true, "Use HTTPS for S3 requests")
+var masterKey = flag.String("masterkey", "", "Hex encoded 256-bit master key to encrypt stored files (optional)")
+var masterKeyFile = flag.String("masterkeyfile", "", "File with hex encoded 256-bit master keys, one per line, to encrypt stored files. The first is current, and the others are previous keys (optional)")
+var chunked = flag.Bool("chunked", false, "Store files as content-defined chunks, storing chunks shared by similar files once")
+var chunkKey = flag.String("chunkkey", "", "Secret key naming the chunks stored with -chunked. It must not change once chunks are stored")
+var rewrapKeys = flag.Bool("rewrapkeys", false, "Re-wrap the data keys of encrypted files with the current master key at startup")
+var scrubInterval = flag.Duration("scrubinterval", 7*24*time.Hour, "How often each stored file is rehashed to detect corruption (0 to disable)")
+var scrubRate = flag.Int64("scrubrate", 8<<20, "Maximum rate in bytes per second at which files are read to detect corruption (0 for no limit)")
+var adminUsers = flag.String("adminusers", "", "Comma-separated IDs of the users permitted to use the admin endpoints")
+var fsckInterval = flag.Duration("fsckinterval", 0, "How often to check the user-file DB against storage, logging any problems (0 to disable)")
 
 func init() {
 	err := startLogger()
@@ -30,14 +53,117 @@ func init() {
 	server.UseLog(log)
 	middleware.UseLog(log)
 	response.UseLog(log)
+	storage.UseLog(log)
+}
+
+// newStorage creates the file storage backend specified by the storage flag.
+func newStorage() (storage.Backend, error) {
+	switch *storageType {
+	case "disk":
+		return storage.NewDisk(server.DefaultFilesPath)
+	case "s3":
+		log.Infof("Using S3 bucket %s at %s for file storage.", *s3Bucket, *s3Endpoint)
+		s3, err := storage.NewS3(&storage.S3Config{
+			Endpoint:  *s3Endpoint,
+			Bucket:    *s3Bucket,
+			AccessKey: *s3AccessKey,
+			SecretKey: *s3SecretKey,
+			Region:    *s3Region,
+			Prefix:    *s3Prefix,
+			Secure:    *s3Secure,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return s3, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", *storageType)
+	}
+}
+
+// masterKeys loads the master keys specified by the masterkey or masterkeyfile
+// flag. No keys are returned if neither is set.
+func masterKeys() ([]storage.MasterKey, error) {
+	switch {
+	case *masterKey != "" && *masterKeyFile != "":
+		return nil, fmt.Errorf("only one of masterkey and masterkeyfile may be set")
+	case *masterKey != "":
+		return storage.ParseMasterKeys(*masterKey)
+	case *masterKeyFile != "":
+		b, err := ioutil.ReadFile(*masterKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return storage.ParseMasterKeys(string(b))
+	}
+	return nil, nil
+}
+
+// encryptStorage wraps the storage backend with an encrypted one if master keys
+// are configured, and re-wraps data keys if requested.
+func encryptStorage(store storage.Backend) (storage.Backend, error) {
+	keys, err := masterKeys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load master keys: %v", err)
+	}
+	if len(keys) == 0 {
+		if *rewrapKeys {
+			return nil, fmt.Errorf("rewrapkeys requires a master key")
+		}
+		return store, nil
+	}
+	encrypted, err := storage.NewEncrypted(store, keys)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Encrypting stored files with master key %s.", keys[0].ID())
+	if *rewrapKeys {
+		n, err := encrypted.Rewrap()
+		if err != nil {
+			return nil, fmt.Errorf("failed to re-wrap data keys: %v", err)
+		}
+		log.Infof("Re-wrapped %d data keys with master key %s.", n, keys[0].ID())
+	}
+	return encrypted, nil
+}
+
+// runFsck runs the fsck command with the given arguments, checking the
+// user-file DB against storage and printing the problems found. The server must
+// not be running, and none of its background tasks are started.
+func runFsck(store storage.Backend, args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	verify := fs.Bool("verify", false, "Rehash stored files to find corrupted files")
+	repair := fs.Bool("repair", false, "Delete orphaned files, damaged data, and dangling DB rows")
+	quarantine := fs.Bool("quarantine", false, "Move orphaned, damaged, and corrupted files to quarantine instead of deleting them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	svr, err := server.NewOfflineServer(store)
+	if err != nil {
+		return err
+	}
+	defer svr.Shutdown()
+
+	report, err := svr.Fsck(&server.FsckOptions{
+		Verify:     *verify,
+		Repair:     *repair,
+		Quarantine: *quarantine,
+	})
+	if err != nil {
+		return fmt.Errorf("fsck failed: %v", err)
+	}
+	for i := range report.Problems {
+		fmt.Println(&report.Problems[i])
+	}
+	fmt.Printf("Checked %d stored files, found %d problems.\n", report.Files,
+		len(report.Problems))
+	return nil
 }
 
 // _main is wrapped by main so that defers will run.
 func _main() error {
-	defer func() {
-		logFILE.Close()
-		os.Stdout.Sync()
-	}()
+	defer os.Stdout.Sync()
 	flag.Parse()
 	if err := setLogLevel(*logLevel); err != nil {
 		return fmt.Errorf("failed to set log level: %v", err)
@@ -52,12 +178,54 @@ func _main() error {
 		return err
 	}
 
+	// File storage backend
+	store, err := newStorage()
+	if err != nil {
+		return fmt.Errorf("failed to create file storage: %v", err)
+	}
+	if store, err = encryptStorage(store); err != nil {
+		return err
+	}
+	if *chunked {
+		if *chunkKey == "" {
+			return fmt.Errorf("chunked requires a chunkkey")
+		}
+		log.Infof("Storing files as deduplicated chunks.")
+		store = storage.NewChunked(store, []byte(*chunkKey))
+	}
+
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "fsck":
+			return runFsck(store, flag.Args()[1:])
+		default:
+			return fmt.Errorf("unknown command %q", flag.Arg(0))
+		}
+	}
+
 	// Construct the Server and path multiplexer.
-	svr, err := server.NewServer(*signingKey, cookieStore, *maxFileSize)
+	svr, err := server.NewServer(*signingKey, cookieStore, *maxFileSize, store,
+		*trashRetention)
 	if err != nil {
 		return fmt.Errorf("failed to create server: %v", err)
 	}
 	defer svr.Shutdown()
+
+	if *fsckInterval > 0 {
+		svr.RunPeriodicFsck(*fsckInterval, &server.FsckOptions{})
+	}
+	if *scrubInterval > 0 {
+		svr.RunScrubber(*scrubInterval, *scrubRate)
+	}
+	svr.AdminUsers = make(map[string]bool)
+	for _, user := range strings.Split(*adminUsers, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			svr.AdminUsers[user] = true
+		}
+	}
+	svr.HideFileExistence = *hideFiles
+	// Compressed files share few chunks.
+	svr.DisableCompression = *chunked
 	webMux := server.NewRouter(svr)
 
 	log.Infof("webfiles is listening on http://%s.", *listen)
@@ -65,8 +233,13 @@ func _main() error {
 }
 
 func main() {
-	if err := _main(); err != nil {
+	// The log file is closed after any error is logged.
+	err := _main()
+	if err != nil {
 		log.Errorf(err.Error())
+	}
+	logFILE.Close()
+	if err != nil {
 		os.Exit(1)
 	}
 	os.Exit(0)
@@ -26,14 +26,17 @@ func UseLog(_log *logrus.Logger) {
 // via jwtauth.FromContext. This should be used after jwtauth.Verify/Verifier.
 func JWTAuthenticator(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token, claims, err := jwtauth.FromContext(r.Context())
+		token, _, err := jwtauth.FromContext(r.Context())
 		if err != nil || token == nil || !token.Valid {
 			http.Error(w, http.StatusText(401), 401)
 			return
 		}
 
-		user := claims["user"].(string)
-		fmt.Println("user: ", user)
+		user := TokenUser(token)
+		if user == "" {
+			http.Error(w, http.StatusText(401), 401)
+			return
+		}
 
 		ctx := context.WithValue(r.Context(), CtxAuthed, true)
 		ctx = context.WithValue(ctx, CtxUser, user)
@@ -60,7 +63,7 @@ func JWTVerify(ja *jwtauth.JWTAuth, injectJWTCookie bool, cookieOpts *sessions.O
 			// Perform JWT verification and store the token and result in the
 			// request context.
 			token, err = jwtauth.VerifyRequest(ja, r, findTokenFns...)
-			if err != nil || token == nil || token.Valid {
+			if err != nil || token == nil || !token.Valid {
 				// No valid token. Continue request processing.
 				next.ServeHTTP(w, r)
 				return
@@ -71,8 +74,7 @@ func JWTVerify(ja *jwtauth.JWTAuth, injectJWTCookie bool, cookieOpts *sessions.O
 				r.AddCookie(sessions.NewCookie("jwt", token.Raw, cookieOpts))
 			}
 
-			user := token.Claims.(jwt.MapClaims)["user"].(string)
-			fmt.Println("user: ", user)
+			user := TokenUser(token)
 
 			ctx := jwtauth.NewContext(r.Context(), token, err)
 			ctx = context.WithValue(ctx, CtxUser, user)
@@ -82,6 +84,17 @@ func JWTVerify(ja *jwtauth.JWTAuth, injectJWTCookie bool, cookieOpts *sessions.O
 	}
 }
 
+// TokenUser extracts the "user" claim from the token. An empty string is
+// returned if the claim is not present.
+func TokenUser(token *jwt.Token) string {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return ""
+	}
+	user, _ := claims["user"].(string)
+	return user
+}
+
 // JWTParse parses the input token string and validates it with the input key.
 func JWTParse(token, key string) (*jwt.Token, error) {
 	return jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
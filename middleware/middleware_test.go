@@ -0,0 +1,60 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/jwtauth"
+)
+
+func TestJWTAuthenticator(t *testing.T) {
+	const key = "test secret"
+	ja := jwtauth.New("HS256", []byte(key), nil)
+	handler := jwtauth.Verifier(ja)(JWTAuthenticator(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Context().Value(CtxUser).(string)))
+		})))
+
+	withUser, _, err := NewSignedJWT(key, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A token without a user claim must be refused rather than panic.
+	noUser, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"user", withUser, http.StatusOK},
+		{"no user claim", noUser, http.StatusUnauthorized},
+		{"no token", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "BEARER "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d", tt.name, rec.Code, tt.status)
+			continue
+		}
+		if rec.Code == http.StatusOK && rec.Body.String() != "alice" {
+			t.Errorf("%s: user %q, expected %q", tt.name, rec.Body.String(), "alice")
+		}
+	}
+}
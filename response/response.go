@@ -4,31 +4,147 @@
 package response
 
 import (
-	"bufio"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
-	"os"
-	"strconv"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 var log = logrus.New()
 
-// Upload describes an uploaded file
+// Upload describes an uploaded file. If the file could not be stored, Error
+// describes the reason. Expires is a Unix timestamp, or zero if the file does
+// not expire. VerifiedDigests lists the digests provided by the client that the
+// file matched, by algorithm, and Mismatches lists those it did not.
 type Upload struct {
-	UID      string `json:"uid"`
-	FileName string `json:"file_name"`
-	Size     int64  `json:"file_size"`
+	UID         string `json:"uid,omitempty"`
+	FileName    string `json:"file_name"`
+	Size        int64  `json:"file_size"`
+	ContentType string `json:"content_type,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	Expires     int64  `json:"expires,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	VerifiedDigests map[string]string `json:"verified_digests,omitempty"`
+	Mismatches      []DigestMismatch  `json:"digest_mismatches,omitempty"`
+}
+
+// DigestMismatch describes a digest provided by the client that does not match
+// the uploaded file. The digests are hex encoded.
+type DigestMismatch struct {
+	Algorithm string `json:"algorithm"`
+	Expected  string `json:"expected"`
+	Actual    string `json:"actual"`
 }
 
-// UploadResponse describes and uploaded file, including user's JWT needed for
-// later access.
+// UploadResponse describes the uploaded files, including user's JWT needed for
+// later access. Upload is the first successfully stored file, and Files lists
+// every file in the request.
 type UploadResponse struct {
 	Upload `json:"file"`
-	Token  string `json:"token"`
+	Files  []Upload `json:"files"`
+	Token  string   `json:"token"`
+}
+
+// PossessionChallenge is a challenge to prove possession of a file that is
+// already stored, instead of uploading it. The proof is the SHA-256 digest of
+// the Nonce, decoded from hex, followed by the Length bytes of the file
+// starting at Offset. Expires is a Unix timestamp.
+type PossessionChallenge struct {
+	Challenge string `json:"challenge"`
+	Offset    int64  `json:"offset"`
+	Length    int64  `json:"length"`
+	Nonce     string `json:"nonce"`
+	Expires   int64  `json:"expires"`
+}
+
+// File describes a stored file. Uploaded is a Unix timestamp, and Checksums
+// maps hash algorithm names to hex encoded digests. Shared indicates that the
+// file was shared with the user by another user.
+type File struct {
+	UID         string            `json:"uid"`
+	Name        string            `json:"name"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"content_type,omitempty"`
+	Uploaded    int64             `json:"uploaded"`
+	Uploader    string            `json:"uploader,omitempty"`
+	Checksums   map[string]string `json:"checksums,omitempty"`
+	Shared      bool              `json:"shared"`
+}
+
+// FileList is a page of a user's files. NextCursor is set if there are more
+// files, and is provided as the "cursor" URL query to request the next page.
+type FileList struct {
+	Files      []File `json:"files"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// TrashedFile describes a file in the user's trash. Deleted and Purge are Unix
+// timestamps of when the file was deleted, and when it will be permanently
+// deleted.
+type TrashedFile struct {
+	UID     string `json:"uid"`
+	Deleted int64  `json:"deleted"`
+	Purge   int64  `json:"purge"`
+}
+
+// Grant describes a user's permission to access a file shared with them.
+// Created is a Unix timestamp.
+type Grant struct {
+	UID     string `json:"uid"`
+	Owner   string `json:"owner"`
+	Grantor string `json:"grantor"`
+	Grantee string `json:"user"`
+	Delete  bool   `json:"delete"`
+	Reshare bool   `json:"reshare"`
+	Created int64  `json:"created"`
+}
+
+// ShareLink describes a public link to a file. Expires and Created are Unix
+// timestamps, and MaxDownloads is zero if downloads are unlimited.
+type ShareLink struct {
+	ID           string `json:"id"`
+	UID          string `json:"uid"`
+	URL          string `json:"url"`
+	Expires      int64  `json:"expires"`
+	MaxDownloads int64  `json:"max_downloads"`
+	Downloads    int64  `json:"downloads"`
+	Created      int64  `json:"created"`
+
+	// Protected indicates that a password is required to download the file.
+	Protected bool `json:"password_protected"`
+}
+
+// ScrubStatus describes the progress of the integrity scrubber, and the files it
+// found corrupt. Interval is how often each file is checked, and RateLimit is
+// the maximum read rate in bytes per second, or zero if unlimited. Started and
+// Completed are Unix timestamps of the start of the current or last run, and
+// the end of the last completed run, or zero if there was none. FilesChecked
+// and BytesChecked count the files checked by the current or last run.
+type ScrubStatus struct {
+	Enabled      bool          `json:"enabled"`
+	Interval     string        `json:"interval,omitempty"`
+	RateLimit    int64         `json:"rate_limit"`
+	Running      bool          `json:"running"`
+	Started      int64         `json:"started"`
+	Completed    int64         `json:"completed"`
+	FilesChecked int64         `json:"files_checked"`
+	BytesChecked int64         `json:"bytes_checked"`
+	CorruptFiles []CorruptFile `json:"corrupt_files"`
+}
+
+// CorruptFile describes a file that failed its integrity check. Checked is a
+// Unix timestamp.
+type CorruptFile struct {
+	UID     string `json:"uid"`
+	Detail  string `json:"detail"`
+	Checked int64  `json:"checked"`
 }
 
 // UseLog sets an external logger for use by this package.
@@ -39,7 +155,13 @@ func UseLog(_log *logrus.Logger) {
 // WriteJSON writes the specified object as JSON, using the specified
 // indentation string.
 func WriteJSON(w http.ResponseWriter, obj interface{}, indent string) {
+	WriteJSONStatus(w, http.StatusOK, obj, indent)
+}
+
+// WriteJSONStatus is like WriteJSON, but with the given http status code.
+func WriteJSONStatus(w http.ResponseWriter, status int, obj interface{}, indent string) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
 	encoder := json.NewEncoder(w)
 	encoder.SetIndent("", indent)
 	if err := encoder.Encode(obj); err != nil {
@@ -49,40 +171,167 @@ func WriteJSON(w http.ResponseWriter, obj interface{}, indent string) {
 
 // WritePlainText sets the Content-Type to text/plain and writes the string.
 func WritePlainText(w http.ResponseWriter, str string) {
-	writeText(w, "text/plain; charset=utf-8", str)
+	writeText(w, "text/plain; charset=utf-8", str, http.StatusOK)
 }
 
 // WriteHTML sets the Content-Type to text/html and writes the string.
 func WriteHTML(w http.ResponseWriter, str string) {
-	writeText(w, "text/html; charset=utf-8", str)
+	WriteHTMLStatus(w, http.StatusOK, str)
+}
+
+// WriteHTMLStatus is like WriteHTML, but with the specified HTTP status code.
+func WriteHTMLStatus(w http.ResponseWriter, status int, str string) {
+	writeText(w, "text/html; charset=utf-8", str, status)
 }
 
-func writeText(w http.ResponseWriter, contentType, str string) {
+func writeText(w http.ResponseWriter, contentType, str string, status int) {
 	w.Header().Set("Content-Type", contentType)
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	io.WriteString(w, str)
 }
 
-// SendFile attempts to transfer the specified file to the ResponseWriter.
-func SendFile(w http.ResponseWriter, filePath string) error {
-	// Attempt to open the specified file. Caller must sanitize.
-	File, err := os.OpenFile(filePath, os.O_RDONLY, 0600)
-	if err != nil {
-		return err
+// inlineTypes are the MIME types that are safe for browsers to display inline,
+// as they cannot execute scripts in the context of this site.
+var inlineTypes = map[string]bool{
+	"application/pdf": true,
+	"audio/mpeg":      true,
+	"audio/ogg":       true,
+	"audio/wav":       true,
+	"image/bmp":       true,
+	"image/gif":       true,
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/webp":      true,
+	"text/plain":      true,
+	"video/mp4":       true,
+	"video/ogg":       true,
+	"video/webm":      true,
+}
+
+// InlineSafe indicates if the content type may be served with an inline
+// Content-Disposition.
+func InlineSafe(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && inlineTypes[mediaType]
+}
+
+// ContentDisposition formats a Content-Disposition header value for the given
+// disposition type (e.g. "attachment") and file name. Per RFC 6266, the
+// filename parameter is an ASCII fallback, and non-ASCII names are also
+// provided in the UTF-8 encoded filename* parameter.
+func ContentDisposition(dispType, fileName string) string {
+	fallback := make([]byte, 0, len(fileName))
+	ascii := true
+	for _, c := range fileName {
+		switch {
+		case c == '"' || c == '\\' || c < ' ' || c == 0x7f:
+			fallback = append(fallback, '_')
+		case c > 0x7f:
+			fallback = append(fallback, '_')
+			ascii = false
+		default:
+			fallback = append(fallback, byte(c))
+		}
+	}
+	disp := fmt.Sprintf(`%s; filename="%s"`, dispType, fallback)
+	if !ascii {
+		disp += "; filename*=UTF-8''" + encodeRFC5987(fileName)
 	}
+	return disp
+}
 
-	// Stat the file for size and base name
-	stat, err := File.Stat()
-	if err != nil {
-		return err
+// encodeRFC5987 percent-encodes all bytes of s except the attr-char set of RFC
+// 5987.
+func encodeRFC5987(s string) string {
+	const hexDigits = "0123456789ABCDEF"
+	enc := make([]byte, 0, 3*len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			strings.IndexByte("!#$&+-.^_`|~", c) >= 0:
+			enc = append(enc, c)
+		default:
+			enc = append(enc, '%', hexDigits[c>>4], hexDigits[c&0xf])
+		}
 	}
+	return string(enc)
+}
+
+// FileInfo describes a file transferred by SendFile.
+type FileInfo struct {
+	// Name is used in the Content-Disposition header.
+	Name string
+	// ContentType is the MIME type of the file. If empty,
+	// application/octet-stream is used.
+	ContentType string
+	// Inline requests an inline Content-Disposition so that a browser may
+	// display the file, which is only honored if the ContentType is
+	// InlineSafe.
+	Inline  bool
+	ModTime time.Time
+	// ETag is the entity tag, without quotes, used to validate conditional
+	// and range requests.
+	ETag string
+	// SHA256 is the SHA-256 digest of the file, which is sent in the Digest
+	// header if set.
+	SHA256 []byte
+	// ContentEncoding is the encoding of the file data, such as gzip, which is
+	// sent in the Content-Encoding header if set.
+	ContentEncoding string
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, stat.Name()))
-	w.Header().Set("Content-Length", strconv.Itoa(int(stat.Size())))
-	w.WriteHeader(http.StatusOK)
+	// IgnoreRanges causes the whole file to be sent in response to range
+	// requests, for files that are costly to read out of order.
+	IgnoreRanges bool
+}
 
-	// Use io.Copy so we do not have to load the entire file into memory.
-	_, err = io.Copy(w, bufio.NewReader(File))
-	return err
+// SendFile transfers the file data read from file to the ResponseWriter. Range
+// requests, including multipart/byteranges, are served with 206 Partial
+// Content, unless info.IgnoreRanges is set, and conditional requests are
+// validated with the ETag and Last-Modified headers, responding with 304 Not
+// Modified as appropriate. The body is omitted for HEAD requests.
+func SendFile(w http.ResponseWriter, r *http.Request, file io.ReadSeeker, info *FileInfo) {
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	dispType := "attachment"
+	if info.Inline && InlineSafe(contentType) {
+		dispType = "inline"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", ContentDisposition(dispType, info.Name))
+	// Browsers must not second guess the Content-Type.
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if info.ETag != "" {
+		w.Header().Set("ETag", `"`+info.ETag+`"`)
+	}
+	if len(info.SHA256) > 0 {
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(info.SHA256))
+	}
+	if info.ContentEncoding != "" {
+		w.Header().Set("Content-Encoding", info.ContentEncoding)
+	}
+
+	if info.IgnoreRanges && r.Header.Get("Range") != "" {
+		r = withoutRange(r)
+	}
+
+	// ServeContent reads from file as needed, so the entire file is not
+	// loaded into memory.
+	http.ServeContent(w, r, info.Name, info.ModTime, file)
+}
+
+// withoutRange returns a copy of the request without its Range header.
+func withoutRange(r *http.Request) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		if k != "Range" {
+			r2.Header[k] = v
+		}
+	}
+	return r2
 }
@@ -0,0 +1,318 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chappjc/webfiles/middleware"
+	"github.com/chappjc/webfiles/response"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/go-chi/chi"
+)
+
+// FileGrant is the type in the storm user-file DB granting a user access to a
+// file that was uploaded by another user. A grant always permits reading the
+// file, and may also permit deleting and resharing it. Owner is the user whose
+// file is shared, and Grantor is the user that created the grant, which is
+// either the Owner or a user that was granted reshare permission.
+type FileGrant struct {
+	ID         int    `storm:"id,increment"`
+	FileID     int64  `storm:"index"`
+	Owner      string `storm:"index"`
+	Grantor    string `storm:"index"`
+	Grantee    string `storm:"index"`
+	CanDelete  bool
+	CanReshare bool
+	Created    time.Time
+}
+
+// userOwnsFile checks for a user-file mapping for the user and file UID. Files
+// in the user's trash and expired files are not considered owned.
+func (s *Server) userOwnsFile(user string, uid uint64) (bool, error) {
+	owned, err := s.UserFileStore.Select(q.Eq("User", user),
+		q.Eq("FileID", int64(uid)), activeMapping()).Count(&UserFileStoreItem{})
+	return owned > 0, err
+}
+
+// activeGrants filters out grants for files that the owner has moved to the
+// trash, or that have expired.
+func (s *Server) activeGrants(grants []FileGrant) ([]FileGrant, error) {
+	active := grants[:0]
+	for i := range grants {
+		owned, err := s.userOwnsFile(grants[i].Owner, uint64(grants[i].FileID))
+		if err != nil {
+			return nil, err
+		}
+		if owned {
+			active = append(active, grants[i])
+		}
+	}
+	return active, nil
+}
+
+// userFileGrant retrieves a grant of access to the file for the user. If there
+// are multiple grants from different owners or grantors, the most permissive
+// is returned. A nil *FileGrant is returned if there is no grant.
+func (s *Server) userFileGrant(user string, uid uint64) (*FileGrant, error) {
+	var grants []FileGrant
+	err := s.UserFileStore.Select(q.Eq("Grantee", user),
+		q.Eq("FileID", int64(uid))).Find(&grants)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if grants, err = s.activeGrants(grants); err != nil || len(grants) == 0 {
+		return nil, err
+	}
+
+	best := &grants[0]
+	for i := range grants[1:] {
+		g := &grants[i+1]
+		if (g.CanDelete && !best.CanDelete) ||
+			(g.CanDelete == best.CanDelete && g.CanReshare && !best.CanReshare) {
+			best = g
+		}
+	}
+	return best, nil
+}
+
+// retrieveSharedFileIDsByUser retrieves a slice of the IDs of files shared with
+// the specified user from the on-disk DB.
+func (s *Server) retrieveSharedFileIDsByUser(user string) ([]int64, error) {
+	var grants []FileGrant
+	err := s.UserFileStore.Find("Grantee", user, &grants)
+	if err != nil {
+		return nil, err
+	}
+	if grants, err = s.activeGrants(grants); err != nil {
+		return nil, err
+	}
+
+	FileIDs := make([]int64, 0, len(grants))
+	for i := range grants {
+		FileIDs = append(FileIDs, grants[i].FileID)
+	}
+	return FileIDs, nil
+}
+
+// grantResponse converts a FileGrant for a JSON response.
+func grantResponse(g *FileGrant) *response.Grant {
+	return &response.Grant{
+		UID:     fmt.Sprintf("%016x", uint64(g.FileID)),
+		Owner:   g.Owner,
+		Grantor: g.Grantor,
+		Grantee: g.Grantee,
+		Delete:  g.CanDelete,
+		Reshare: g.CanReshare,
+		Created: g.Created.Unix(),
+	}
+}
+
+// GrantFile is the handler for POST requests to share a file with another user,
+// requiring the "{fileid}" URL path parameter (e.g. /file/{fileid}/grants). The
+// form values are "user", the user ID of the grantee, and the optional "delete"
+// and "reshare" booleans. The file's owner may grant any permission, while a
+// user with reshare permission may grant only the permissions they hold. An
+// existing grant by the same grantor to the same user is replaced.
+func (s *Server) GrantFile(w http.ResponseWriter, r *http.Request) {
+	user := middleware.RequestCtxUser(r)
+	fileID := chi.URLParam(r, "fileid")
+	uid, err := parseUID(fileID)
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	grantee := r.FormValue("user")
+	if grantee == "" || grantee == user {
+		http.Error(w, "invalid user", http.StatusBadRequest)
+		return
+	}
+	var canDelete, canReshare bool
+	if v := r.FormValue("delete"); v != "" {
+		if canDelete, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid delete value", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.FormValue("reshare"); v != "" {
+		if canReshare, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid reshare value", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The owner may grant any permission. Otherwise, the user must hold a
+	// grant with reshare permission, and may not grant more than they hold.
+	owner := user
+	owned, err := s.userOwnsFile(user, uid)
+	if err != nil {
+		log.Errorf("Failed to check ownership of file %s: %v", fileID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !owned {
+		grant, err := s.userFileGrant(user, uid)
+		if err != nil {
+			log.Errorf("Failed to retrieve grant for file %s: %v", fileID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if grant == nil {
+			s.refuseFileAccess(w, uid)
+			return
+		}
+		if !grant.CanReshare || (canDelete && !grant.CanDelete) {
+			http.Error(w, "insufficient permission to share file "+fileID,
+				http.StatusForbidden)
+			return
+		}
+		owner = grant.Owner
+	}
+
+	// Replace any existing grant by this grantor.
+	grant := FileGrant{
+		FileID:     int64(uid),
+		Owner:      owner,
+		Grantor:    user,
+		Grantee:    grantee,
+		CanDelete:  canDelete,
+		CanReshare: canReshare,
+		Created:    time.Now(),
+	}
+	var existing FileGrant
+	err = s.UserFileStore.Select(q.Eq("FileID", grant.FileID), q.Eq("Grantor", user),
+		q.Eq("Grantee", grantee)).First(&existing)
+	if err == nil {
+		grant.ID = existing.ID
+	}
+	if err == nil || err == storm.ErrNotFound {
+		err = s.UserFileStore.Save(&grant)
+	}
+	if err != nil {
+		log.Errorf("Failed to store grant for file %s: %v", fileID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("User %s granted %s access to file %s.", user, grantee, fileID)
+	response.WriteJSON(w, grantResponse(&grant), "    ")
+}
+
+// RevokeFileGrant is the handler for DELETE requests to stop sharing a file with
+// a user, requiring the "{fileid}" and "{grantee}" URL path parameters (e.g.
+// /file/{fileid}/grants/{grantee}). The file's owner may revoke any grant to
+// the user that was made for their file, while other grantors may revoke only
+// their own grants.
+func (s *Server) RevokeFileGrant(w http.ResponseWriter, r *http.Request) {
+	user := middleware.RequestCtxUser(r)
+	fileID := chi.URLParam(r, "fileid")
+	uid, err := parseUID(fileID)
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	grantee := chi.URLParam(r, "grantee")
+
+	var grants []FileGrant
+	err = s.UserFileStore.Select(q.Eq("FileID", int64(uid)), q.Eq("Grantee", grantee),
+		q.Or(q.Eq("Owner", user), q.Eq("Grantor", user))).Find(&grants)
+	if err == storm.ErrNotFound {
+		http.Error(w, "grant not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to retrieve grants for file %s: %v", fileID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = s.deleteGrants(grants); err != nil {
+		log.Errorf("Failed to delete grant for file %s: %v", fileID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("User %s revoked %s's access to file %s.", user, grantee, fileID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteGrants deletes the grants, and any grants made by the grantees by
+// resharing the same owner's file, unless the grantee still holds another grant
+// for the file from that owner.
+func (s *Server) deleteGrants(grants []FileGrant) error {
+	for len(grants) > 0 {
+		g := grants[0]
+		grants = grants[1:]
+		if err := s.UserFileStore.DeleteStruct(&g); err != nil {
+			return err
+		}
+
+		remaining, err := s.UserFileStore.Select(q.Eq("FileID", g.FileID),
+			q.Eq("Owner", g.Owner), q.Eq("Grantee", g.Grantee)).Count(&FileGrant{})
+		if err != nil {
+			return err
+		}
+		if remaining > 0 {
+			continue
+		}
+
+		var reshared []FileGrant
+		err = s.UserFileStore.Select(q.Eq("FileID", g.FileID), q.Eq("Owner", g.Owner),
+			q.Eq("Grantor", g.Grantee)).Find(&reshared)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		grants = append(grants, reshared...)
+	}
+	return nil
+}
+
+// FileGrants is the handler for listing the grants for a file, requiring the
+// "{fileid}" URL path parameter (e.g. /file/{fileid}/grants). The file's owner
+// sees all grants made for their file, while other users see only the grants
+// they made.
+func (s *Server) FileGrants(w http.ResponseWriter, r *http.Request) {
+	user := middleware.RequestCtxUser(r)
+	fileID := chi.URLParam(r, "fileid")
+	uid, err := parseUID(fileID)
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	status, err := s.fileAccessStatus(user, uid)
+	if err != nil {
+		log.Errorf("Failed to check access to file %s: %v", fileID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status != http.StatusOK {
+		s.refuseFileAccess(w, uid)
+		return
+	}
+
+	var grants []FileGrant
+	err = s.UserFileStore.Select(q.Eq("FileID", int64(uid)),
+		q.Or(q.Eq("Owner", user), q.Eq("Grantor", user))).Find(&grants)
+	if err != nil && err != storm.ErrNotFound {
+		log.Errorf("Failed to retrieve grants for file %s: %v", fileID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]*response.Grant, 0, len(grants))
+	for i := range grants {
+		resp = append(resp, grantResponse(&grants[i]))
+	}
+	response.WriteJSON(w, resp, "    ")
+}
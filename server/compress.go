@@ -0,0 +1,280 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/chappjc/webfiles/storage"
+)
+
+// encodingGzip is the content encoding of files that are stored compressed.
+const encodingGzip = "gzip"
+
+// compressibleTypes are the MIME types, other than text/*, that are compressed
+// when stored.
+var compressibleTypes = map[string]bool{
+	"application/json":         true,
+	"application/x-ndjson":     true,
+	"application/xml":          true,
+	"application/javascript":   true,
+	"application/x-javascript": true,
+	"application/x-yaml":       true,
+	"application/yaml":         true,
+	"application/toml":         true,
+	"application/csv":          true,
+	"application/sql":          true,
+	"application/x-sh":         true,
+	"application/x-tar":        true,
+	"application/postscript":   true,
+	"image/svg+xml":            true,
+	"image/bmp":                true,
+}
+
+// compressibleType checks if files with the given MIME type are likely to
+// compress well.
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType] ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// compressor is an io.Writer that detects the content type of the file written
+// to it, and writes it to dst, compressed with gzip if enabled and the type is
+// compressible. The first bytes are buffered until the type is known. Close
+// must be called to flush the data.
+type compressor struct {
+	dst         io.Writer
+	fileName    string
+	enabled     bool
+	sniffer     contentSniffer
+	contentType string
+	encoding    string
+	gz          *gzip.Writer
+	w           io.Writer
+}
+
+// newCompressor creates a compressor writing to dst for a file with the given
+// name. If enabled is false, the file is only written, not compressed.
+func newCompressor(dst io.Writer, fileName string, enabled bool) *compressor {
+	return &compressor{
+		dst:      dst,
+		fileName: fileName,
+		enabled:  enabled,
+	}
+}
+
+// detect determines the content type and encoding, and writes the buffered
+// data.
+func (c *compressor) detect() error {
+	c.contentType = detectContentType(c.fileName, c.sniffer.data)
+	c.w = c.dst
+	if c.enabled && compressibleType(c.contentType) {
+		c.encoding = encodingGzip
+		c.gz = gzip.NewWriter(c.dst)
+		c.w = c.gz
+	}
+	_, err := c.w.Write(c.sniffer.data)
+	return err
+}
+
+// Write buffers data until the content type is known, and then writes it,
+// compressed if the type is compressible.
+func (c *compressor) Write(p []byte) (int, error) {
+	if c.w != nil {
+		return c.w.Write(p)
+	}
+	n := len(p)
+	need := sniffLen - len(c.sniffer.data)
+	if need > len(p) {
+		need = len(p)
+	}
+	c.sniffer.Write(p[:need])
+	if len(c.sniffer.data) < sniffLen {
+		return n, nil
+	}
+	if err := c.detect(); err != nil {
+		return 0, err
+	}
+	if _, err := c.w.Write(p[need:]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Close writes any buffered data, and completes the compressed stream. It does
+// not close dst.
+func (c *compressor) Close() error {
+	if c.w == nil {
+		if err := c.detect(); err != nil {
+			return err
+		}
+	}
+	if c.gz != nil {
+		return c.gz.Close()
+	}
+	return nil
+}
+
+// gunzipFile is a storage.File that decompresses a gzip compressed file as it
+// is read. Seeking backward restarts decompression from the beginning of the
+// file, and seeking forward discards the decompressed data in between, so
+// reading out of order is costly.
+type gunzipFile struct {
+	f  storage.File
+	zr *gzip.Reader
+	// size is the decompressed length, or -1 until it is known.
+	size int64
+	// pos is the position of the next Read, and zpos is the position of zr.
+	pos  int64
+	zpos int64
+}
+
+// newGunzipFile creates a gunzipFile for the compressed file f. If size, the
+// decompressed length, is negative, it is determined when needed by
+// decompressing the file.
+func newGunzipFile(f storage.File, size int64) *gunzipFile {
+	return &gunzipFile{f: f, size: size}
+}
+
+// rewind restarts decompression from the beginning of the file.
+func (g *gunzipFile) rewind() error {
+	if _, err := g.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var err error
+	if g.zr == nil {
+		g.zr, err = gzip.NewReader(g.f)
+	} else {
+		err = g.zr.Reset(g.f)
+	}
+	g.zpos = 0
+	return err
+}
+
+// Read decompresses data from the current position.
+func (g *gunzipFile) Read(p []byte) (int, error) {
+	if g.size >= 0 && g.pos >= g.size {
+		return 0, io.EOF
+	}
+	if g.zr == nil || g.pos < g.zpos {
+		if err := g.rewind(); err != nil {
+			return 0, err
+		}
+	}
+	if g.pos > g.zpos {
+		n, err := io.CopyN(ioutil.Discard, g.zr, g.pos-g.zpos)
+		g.zpos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := g.zr.Read(p)
+	g.pos += int64(n)
+	g.zpos += int64(n)
+	return n, err
+}
+
+// Seek sets the position for the next Read. See io.Seeker.
+func (g *gunzipFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += g.pos
+	case io.SeekEnd:
+		if g.size < 0 {
+			if err := g.rewind(); err != nil {
+				return g.pos, err
+			}
+			n, err := io.Copy(ioutil.Discard, g.zr)
+			if err != nil {
+				return g.pos, err
+			}
+			g.size, g.zpos = n, n
+		}
+		offset += g.size
+	default:
+		return g.pos, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return g.pos, errors.New("negative position")
+	}
+	g.pos = offset
+	return offset, nil
+}
+
+// Close closes the compressed file.
+func (g *gunzipFile) Close() error {
+	return g.f.Close()
+}
+
+// openStoredFile opens the stored file with the given UID for reading,
+// decompressing it if it was stored compressed. The FileInfo describes the
+// decompressed file.
+func (s *Server) openStoredFile(uid uint64) (storage.File, *storage.FileInfo, error) {
+	file, info, err := s.Storage.Get(fmt.Sprintf("%016x", uid))
+	if err != nil {
+		return nil, nil, err
+	}
+	switch info.ContentEncoding {
+	case "":
+		return file, info, nil
+	case encodingGzip:
+		size := int64(-1)
+		var rec FileRecord
+		if err = s.UserFileStore.One("FileID", int64(uid), &rec); err == nil {
+			size = rec.Size
+		}
+		g := newGunzipFile(file, size)
+		if info.Size, err = g.Seek(0, io.SeekEnd); err != nil {
+			g.Close()
+			return nil, nil, err
+		}
+		g.Seek(0, io.SeekStart)
+		info.ContentEncoding = ""
+		return g, info, nil
+	default:
+		file.Close()
+		return nil, nil, fmt.Errorf("unknown content encoding %q", info.ContentEncoding)
+	}
+}
+
+// acceptsGzip checks if the request's Accept-Encoding header permits a gzip
+// encoded response. An explicit gzip coding takes precedence over "*".
+func acceptsGzip(r *http.Request) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, field := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(field, ";")
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(parts[0])) {
+		case encodingGzip, "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"net/textproto"
+	"net/url"
+	"strings"
+
+	"github.com/chappjc/webfiles/response"
+)
+
+// digestAlgorithms are the supported algorithms for client-provided digests,
+// named as in the HTTP Digest and Repr-Digest headers.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// errInvalidDigest is returned for a malformed client-provided digest.
+var errInvalidDigest = errors.New("invalid digest")
+
+// expectedDigest is a digest provided by the client that an uploaded file must
+// match.
+type expectedDigest struct {
+	alg string
+	sum []byte
+}
+
+// digestMismatchError is returned when an uploaded file does not match the
+// digests provided by the client.
+type digestMismatchError struct {
+	mismatches []response.DigestMismatch
+}
+
+func (e *digestMismatchError) Error() string {
+	algs := make([]string, 0, len(e.mismatches))
+	for i := range e.mismatches {
+		algs = append(algs, e.mismatches[i].Algorithm)
+	}
+	return "digest mismatch: " + strings.Join(algs, ", ")
+}
+
+// parseUploadDigests collects the digests that an uploaded file must match
+// from the headers of its multipart part, and from the form values that
+// preceded it. The headers are Content-MD5, Digest (RFC 3230), and Repr-Digest
+// (RFC 9530), and the form value is "sha256", a hex encoded SHA-256 digest.
+// Digests with unsupported algorithms are ignored.
+func parseUploadDigests(hdr textproto.MIMEHeader, form url.Values) ([]expectedDigest, error) {
+	var digests []expectedDigest
+	add := func(alg string, sum []byte, err error) error {
+		if err != nil || len(sum) != digestAlgorithms[alg]().Size() {
+			return errInvalidDigest
+		}
+		digests = append(digests, expectedDigest{alg, sum})
+		return nil
+	}
+
+	if v := hdr.Get("Content-MD5"); v != "" {
+		sum, err := base64.StdEncoding.DecodeString(v)
+		if err = add("md5", sum, err); err != nil {
+			return nil, err
+		}
+	}
+	for _, field := range []string{"Digest", "Repr-Digest"} {
+		v := hdr.Get(field)
+		if v == "" {
+			continue
+		}
+		for _, item := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+			if len(kv) != 2 {
+				return nil, errInvalidDigest
+			}
+			alg := strings.ToLower(kv[0])
+			if digestAlgorithms[alg] == nil {
+				continue
+			}
+			val := kv[1]
+			// Repr-Digest values are structured field byte sequences.
+			if field == "Repr-Digest" {
+				if len(val) < 2 || val[0] != ':' || val[len(val)-1] != ':' {
+					return nil, errInvalidDigest
+				}
+				val = val[1 : len(val)-1]
+			}
+			sum, err := base64.StdEncoding.DecodeString(val)
+			if err = add(alg, sum, err); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if v := form.Get("sha256"); v != "" {
+		sum, err := hex.DecodeString(v)
+		if err = add("sha-256", sum, err); err != nil {
+			return nil, err
+		}
+	}
+	return digests, nil
+}
+
+// digestVerifier computes the digests of the data written to it for the
+// algorithms of the expected digests.
+type digestVerifier struct {
+	expected []expectedDigest
+	hashers  map[string]hash.Hash
+}
+
+// newDigestVerifier creates a digestVerifier for the expected digests. The
+// SHA-256 hash is computed for every upload, so it may be provided rather than
+// computed twice.
+func newDigestVerifier(expected []expectedDigest, sha256Hasher hash.Hash) *digestVerifier {
+	dv := &digestVerifier{
+		expected: expected,
+		hashers:  map[string]hash.Hash{"sha-256": sha256Hasher},
+	}
+	for _, d := range expected {
+		if dv.hashers[d.alg] == nil {
+			dv.hashers[d.alg] = digestAlgorithms[d.alg]()
+		}
+	}
+	return dv
+}
+
+// Write writes to the hashers other than the provided SHA-256 hash.
+func (dv *digestVerifier) Write(p []byte) (int, error) {
+	for alg, h := range dv.hashers {
+		if alg != "sha-256" {
+			h.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// verify checks the computed digests against the expected digests. The
+// verified digests are returned, hex encoded, by algorithm. If any digest does
+// not match, a *digestMismatchError is returned.
+func (dv *digestVerifier) verify() (map[string]string, error) {
+	if len(dv.expected) == 0 {
+		return nil, nil
+	}
+	verified := make(map[string]string, len(dv.expected))
+	var mismatches []response.DigestMismatch
+	for _, d := range dv.expected {
+		sum := dv.hashers[d.alg].Sum(nil)
+		if !bytes.Equal(sum, d.sum) {
+			mismatches = append(mismatches, response.DigestMismatch{
+				Algorithm: d.alg,
+				Expected:  hex.EncodeToString(d.sum),
+				Actual:    hex.EncodeToString(sum),
+			})
+			continue
+		}
+		verified[d.alg] = hex.EncodeToString(sum)
+	}
+	if len(mismatches) > 0 {
+		return nil, &digestMismatchError{mismatches}
+	}
+	return verified, nil
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+)
+
+// expirySweepInterval is how often the expiry sweeper looks for expired files
+// to delete.
+const expirySweepInterval = time.Minute
+
+// errInvalidExpiry is returned by parseExpiry for invalid or past expiry times.
+var errInvalidExpiry = errors.New("invalid expires_in or expires_at")
+
+// parseExpiry determines the Unix time when an upload expires from either an
+// "expires_in" duration such as "72h", or an "expires_at" time, which may be an
+// RFC 3339 time or a Unix timestamp. Zero is returned if both are empty, and
+// errInvalidExpiry if both are specified.
+func parseExpiry(expiresIn, expiresAt string) (int64, error) {
+	now := time.Now()
+	switch {
+	case expiresIn != "" && expiresAt != "":
+		return 0, errInvalidExpiry
+	case expiresIn != "":
+		lifetime, err := time.ParseDuration(expiresIn)
+		if err != nil || lifetime <= 0 {
+			return 0, errInvalidExpiry
+		}
+		return now.Add(lifetime).Unix(), nil
+	case expiresAt != "":
+		expires, err := strconv.ParseInt(expiresAt, 10, 64)
+		if err != nil {
+			t, err := time.Parse(time.RFC3339, expiresAt)
+			if err != nil {
+				return 0, errInvalidExpiry
+			}
+			expires = t.Unix()
+		}
+		if expires <= now.Unix() {
+			return 0, errInvalidExpiry
+		}
+		return expires, nil
+	}
+	return 0, nil
+}
+
+// userFileExpired checks if the user's access to the file with the given UID
+// has expired, either because the user's own upload of the file expired, or
+// because the file was shared with the user by an owner whose upload expired.
+func (s *Server) userFileExpired(user string, uid uint64) (bool, error) {
+	expired, err := s.UserFileStore.Select(q.Eq("User", user),
+		q.Eq("FileID", int64(uid)), expiredMapping()).Count(&UserFileStoreItem{})
+	if err != nil || expired > 0 {
+		return expired > 0, err
+	}
+
+	var grants []FileGrant
+	err = s.UserFileStore.Select(q.Eq("Grantee", user),
+		q.Eq("FileID", int64(uid))).Find(&grants)
+	if err == storm.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for i := range grants {
+		expired, err = s.UserFileStore.Select(q.Eq("User", grants[i].Owner),
+			q.Eq("FileID", int64(uid)), expiredMapping()).Count(&UserFileStoreItem{})
+		if err != nil || expired > 0 {
+			return expired > 0, err
+		}
+	}
+	return false, nil
+}
+
+// sweepExpired deletes the expired files.
+func (s *Server) sweepExpired() {
+	now := time.Now().Unix()
+	var mappings []UserFileStoreItem
+	err := s.UserFileStore.Select(q.Gt("Expires", int64(0)),
+		q.Lte("Expires", now)).Find(&mappings)
+	if err != nil {
+		if err != storm.ErrNotFound {
+			log.Errorf("Failed to retrieve expired files: %v", err)
+		}
+		return
+	}
+
+	for i := range mappings {
+		m := &mappings[i]
+		// The file may have been uploaded again with a new expiry since it
+		// was found.
+		err = s.deleteUserFile(m.User, uint64(m.FileID), q.Gt("Expires", int64(0)),
+			q.Lte("Expires", now))
+		if err == storm.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			log.Errorf("Failed to delete expired file %016x: %v", m.FileID, err)
+			continue
+		}
+		log.Infof("Deleted %s's expired file %016x.", m.User, m.FileID)
+	}
+}
+
+// expirySweeper periodically deletes expired files until the Server is shut
+// down.
+func (s *Server) expirySweeper() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(expirySweepInterval)
+	defer ticker.Stop()
+	for {
+		s.sweepExpired()
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+	}
+}
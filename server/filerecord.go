@@ -0,0 +1,285 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chappjc/webfiles/middleware"
+	"github.com/chappjc/webfiles/response"
+
+	"github.com/asdine/storm"
+	"github.com/go-chi/chi"
+)
+
+const (
+	defaultFileListLimit = 100
+	maxFileListLimit     = 1000
+)
+
+// FileRecord is the type in the storm user-file DB describing a stored file.
+// There is one record per file UID, shared by all users that uploaded the same
+// file. Uploaded and Uploader describe the first upload of the file, and Name
+// is from the most recent upload. Checksums maps hash algorithm names to hex
+// encoded digests of the file. The "xxh64" digest is usually the UID, but not
+// if the UID was changed to avoid a collision (see allocateUID).
+type FileRecord struct {
+	FileID      int64 `storm:"id"`
+	Name        string
+	Size        int64
+	ContentType string
+	Uploaded    time.Time
+	Uploader    string `storm:"index"`
+	Checksums   map[string]string
+
+	// SHA256 is the hex encoded SHA-256 digest, also in Checksums, indexed
+	// for lookups by hash. It is empty for files stored before SHA-256
+	// digests were computed.
+	SHA256 string `storm:"index"`
+}
+
+// storeFileRecord creates or updates the record for a stored file.
+func (s *Server) storeFileRecord(rec *FileRecord) error {
+	var existing FileRecord
+	err := s.UserFileStore.One("FileID", rec.FileID, &existing)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	if err == nil {
+		rec.Uploaded = existing.Uploaded
+		rec.Uploader = existing.Uploader
+	}
+	return s.UserFileStore.Save(rec)
+}
+
+// fileRecord retrieves the record for the file with the given UID. Files
+// stored before records were kept have no record, so one is created from the
+// storage Backend's description of the file, without an uploader or checksums.
+func (s *Server) fileRecord(uid uint64) (*FileRecord, error) {
+	var rec FileRecord
+	err := s.UserFileStore.One("FileID", int64(uid), &rec)
+	if err == nil {
+		return &rec, nil
+	}
+	if err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	info, err := s.Storage.Stat(fmt.Sprintf("%016x", uid))
+	if err != nil {
+		return nil, err
+	}
+	return &FileRecord{
+		FileID:      int64(uid),
+		Name:        info.Name,
+		Size:        info.Size,
+		ContentType: info.ContentType,
+		Uploaded:    info.ModTime,
+	}, nil
+}
+
+// fileRecordResponse converts a FileRecord for a JSON response to the given
+// user. The uploader is included only if it is the user, since the record of a
+// file uploaded by several users names the first of them.
+func fileRecordResponse(rec *FileRecord, user string, shared bool) response.File {
+	file := response.File{
+		UID:         fmt.Sprintf("%016x", uint64(rec.FileID)),
+		Name:        rec.Name,
+		Size:        rec.Size,
+		ContentType: rec.ContentType,
+		Uploaded:    rec.Uploaded.Unix(),
+		Checksums:   rec.Checksums,
+		Shared:      shared,
+	}
+	if rec.Uploader == user {
+		file.Uploader = user
+	}
+	return file
+}
+
+// fileListOptions are the sorting, filtering, and pagination options for a
+// file list.
+type fileListOptions struct {
+	sortBy string
+	desc   bool
+	name   string
+	mime   string
+	limit  int
+	offset int
+}
+
+// parseFileListOptions parses the URL query of a file list request. The
+// options are "sort" (name, size, or date, the default), "order" (asc, the
+// default, or desc), "name" (a case-insensitive substring of the file name),
+// "type" (a MIME type such as "text/plain", or "image/*" for any image type),
+// "limit" (the maximum number of files, default 100), and "cursor" (from the
+// previous page).
+func parseFileListOptions(query url.Values) (*fileListOptions, error) {
+	opts := &fileListOptions{
+		sortBy: "date",
+		name:   strings.ToLower(query.Get("name")),
+		mime:   strings.ToLower(query.Get("type")),
+		limit:  defaultFileListLimit,
+	}
+
+	if v := query.Get("sort"); v != "" {
+		switch v {
+		case "name", "size", "date":
+			opts.sortBy = v
+		default:
+			return nil, fmt.Errorf("invalid sort")
+		}
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.desc = true
+	default:
+		return nil, fmt.Errorf("invalid order")
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxFileListLimit {
+			return nil, fmt.Errorf("invalid limit")
+		}
+		opts.limit = limit
+	}
+	if v := query.Get("cursor"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		opts.offset = offset
+	}
+	return opts, nil
+}
+
+// matches checks the file against the name and type filters.
+func (opts *fileListOptions) matches(f *response.File) bool {
+	if opts.name != "" && !strings.Contains(strings.ToLower(f.Name), opts.name) {
+		return false
+	}
+	if opts.mime == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(f.ContentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasSuffix(opts.mime, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(opts.mime, "*"))
+	}
+	return mediaType == opts.mime
+}
+
+// apply filters, sorts, and paginates the files.
+func (opts *fileListOptions) apply(files []response.File) *response.FileList {
+	matched := files[:0]
+	for i := range files {
+		if opts.matches(&files[i]) {
+			matched = append(matched, files[i])
+		}
+	}
+
+	less := func(a, b *response.File) bool {
+		switch opts.sortBy {
+		case "name":
+			aName, bName := strings.ToLower(a.Name), strings.ToLower(b.Name)
+			if aName != bName {
+				return aName < bName
+			}
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		}
+		if a.Uploaded != b.Uploaded {
+			return a.Uploaded < b.Uploaded
+		}
+		return a.UID < b.UID
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if opts.desc {
+			return less(&matched[j], &matched[i])
+		}
+		return less(&matched[i], &matched[j])
+	})
+
+	list := &response.FileList{Files: []response.File{}}
+	if opts.offset >= len(matched) {
+		return list
+	}
+	end := opts.offset + opts.limit
+	if end < len(matched) {
+		list.NextCursor = strconv.Itoa(end)
+	} else {
+		end = len(matched)
+	}
+	list.Files = matched[opts.offset:end]
+	return list
+}
+
+// FileBySHA256 is the handler for looking up a file by its SHA-256 digest,
+// requiring the "{hash}" URL path parameter, the hex encoded digest (e.g.
+// /by-hash/sha256/{hash}). If the user may access the file, it is described in
+// the response, so clients may check if they already have a file before
+// uploading it. Otherwise, the response is http.StatusNotFound whether or not
+// the file is stored, so that users cannot learn which files others have
+// stored.
+func (s *Server) FileBySHA256(w http.ResponseWriter, r *http.Request) {
+	hash := strings.ToLower(chi.URLParam(r, "hash"))
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+		http.Error(w, "invalid SHA-256 digest", http.StatusBadRequest)
+		return
+	}
+
+	var rec FileRecord
+	err := s.UserFileStore.One("SHA256", hash, &rec)
+	if err == storm.ErrNotFound {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to look up file by SHA-256 digest %s: %v", hash, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user := middleware.RequestCtxUser(r)
+	uid := uint64(rec.FileID)
+	status, err := s.fileAccessStatus(user, uid)
+	if err != nil {
+		log.Errorf("Failed to check access to file %016x: %v", uid, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status != http.StatusOK {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	owned, err := s.userOwnsFile(user, uid)
+	if err != nil {
+		log.Errorf("Failed to check ownership of file %016x: %v", uid, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name, err := s.userFileName(user, uid)
+	if err != nil {
+		log.Errorf("Failed to retrieve name of file %016x: %v", uid, err)
+	}
+	if name != "" {
+		rec.Name = name
+	}
+	response.WriteJSON(w, fileRecordResponse(&rec, user, !owned), "    ")
+}
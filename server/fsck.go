@@ -0,0 +1,330 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/chappjc/webfiles/storage"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+)
+
+// Kinds of problems found by Fsck.
+const (
+	// FsckOrphan is a stored file with no user-file mapping.
+	FsckOrphan = "orphan"
+	// FsckDangling is a DB row for a file that is not stored.
+	FsckDangling = "dangling"
+	// FsckMismatch is a stored file whose contents do not match its UID or
+	// recorded digest.
+	FsckMismatch = "mismatch"
+	// FsckDamaged is stored data that is not a usable file, such as a
+	// folder with no NAME file or an abandoned upload.
+	FsckDamaged = "damaged"
+	// FsckUnreadable is a stored file that could not be read to rehash it,
+	// which may be a transient failure.
+	FsckUnreadable = "unreadable"
+)
+
+// FsckOptions control what Fsck checks and fixes.
+type FsckOptions struct {
+	// Verify rehashes each stored file to find mismatches, which requires
+	// reading every file.
+	Verify bool
+	// Repair deletes orphaned files, damaged data, and dangling DB rows.
+	// Files with mismatched contents are not deleted.
+	Repair bool
+	// Quarantine moves orphaned files, damaged data, and files with
+	// mismatched contents aside rather than deleting them, if the storage
+	// Backend supports it. Dangling DB rows are deleted.
+	Quarantine bool
+}
+
+// FsckProblem describes a problem found by Fsck. Name is the file UID, or the
+// storage entry for damaged data, and Action describes what was done about
+// it, if anything.
+type FsckProblem struct {
+	Kind   string
+	Name   string
+	Detail string
+	Action string
+}
+
+func (p *FsckProblem) String() string {
+	str := fmt.Sprintf("%s %s: %s", p.Kind, p.Name, p.Detail)
+	if p.Action != "" {
+		str += " (" + p.Action + ")"
+	}
+	return str
+}
+
+// FsckReport lists the problems found by Fsck.
+type FsckReport struct {
+	Files    int
+	Problems []FsckProblem
+}
+
+// Fsck cross-checks the user-file DB against the storage Backend. It finds
+// stored files that no user has (orphans), DB rows for files that are not
+// stored (dangling), and data the Backend reports as damaged, and optionally
+// rehashes each stored file. A file that can not be read is reported, and the
+// check continues. Problems are fixed according to opts. Uploads and
+// deletions wait while the DB and storage are compared and fixed, but not
+// while files are rehashed.
+func (s *Server) Fsck(opts *FsckOptions) (*FsckReport, error) {
+	report := new(FsckReport)
+	uids, err := s.fsckCompare(opts, report)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Verify {
+		for _, uid := range uids {
+			detail, _, err := s.verifyStoredFile(uid, nil)
+			if err != nil {
+				report.Problems = append(report.Problems, FsckProblem{
+					Kind:   FsckUnreadable,
+					Name:   fmt.Sprintf("%016x", uid),
+					Detail: "failed to read file: " + err.Error(),
+				})
+				continue
+			}
+			if detail == "" {
+				continue
+			}
+			p := FsckProblem{
+				Kind:   FsckMismatch,
+				Name:   fmt.Sprintf("%016x", uid),
+				Detail: detail,
+			}
+			if opts.Quarantine {
+				p.Action = s.fsckQuarantine(uid)
+			}
+			report.Problems = append(report.Problems, p)
+		}
+	}
+	return report, nil
+}
+
+// fsckCompare finds orphaned files, dangling DB rows, and damaged data, and
+// fixes them according to opts. The UIDs of the stored files that users have
+// are returned.
+func (s *Server) fsckCompare(opts *FsckOptions, report *FsckReport) ([]uint64, error) {
+	s.fileMtx.Lock()
+	defer s.fileMtx.Unlock()
+
+	list, err := s.Storage.List()
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[uint64]bool, len(list))
+	uids := make([]uint64, 0, len(list))
+	for _, UID := range list {
+		uid, err := strconv.ParseUint(UID, 16, 64)
+		if err != nil || len(UID) != 16 {
+			continue
+		}
+		stored[uid] = true
+		uids = append(uids, uid)
+	}
+	report.Files = len(uids)
+
+	// Every mapping, including those of files in the trash, keeps a file.
+	var mappings []UserFileStoreItem
+	if err = s.UserFileStore.All(&mappings); err != nil {
+		return nil, err
+	}
+	mapped := make(map[uint64]bool, len(mappings))
+	for i := range mappings {
+		mapped[uint64(mappings[i].FileID)] = true
+	}
+
+	// Only mapped files are rehashed, so orphans are not also reported as
+	// mismatched.
+	mappedUIDs := make([]uint64, 0, len(uids))
+	for _, uid := range uids {
+		if mapped[uid] {
+			mappedUIDs = append(mappedUIDs, uid)
+			continue
+		}
+		p := FsckProblem{
+			Kind:   FsckOrphan,
+			Name:   fmt.Sprintf("%016x", uid),
+			Detail: "stored file has no user-file mapping",
+		}
+		switch {
+		case opts.Quarantine:
+			p.Action = s.fsckQuarantine(uid)
+		case opts.Repair:
+			p.Action = "deleted"
+			if err = s.Storage.Delete(p.Name); err != nil && err != storage.ErrNotFound {
+				p.Action = "delete failed: " + err.Error()
+			}
+		}
+		report.Problems = append(report.Problems, p)
+	}
+
+	dangling, err := s.fsckDangling(stored, mappings)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range dangling {
+		if opts.Repair || opts.Quarantine {
+			p.Action = "deleted rows"
+			if err = s.deleteFileRows(p.Name); err != nil {
+				p.Action = "delete failed: " + err.Error()
+			}
+		}
+		report.Problems = append(report.Problems, p)
+	}
+
+	if checker, ok := s.Storage.(storage.Checker); ok {
+		damaged, err := checker.Damaged()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range damaged {
+			p := FsckProblem{
+				Kind:   FsckDamaged,
+				Name:   name,
+				Detail: "stored data is not a usable file",
+			}
+			if opts.Repair || opts.Quarantine {
+				p.Action = "deleted"
+				if opts.Quarantine {
+					p.Action = "quarantined"
+				}
+				if err = checker.RemoveDamaged(name, opts.Quarantine); err != nil {
+					p.Action = "removal failed: " + err.Error()
+				}
+			}
+			report.Problems = append(report.Problems, p)
+		}
+	}
+	return mappedUIDs, nil
+}
+
+// fsckDangling finds the files referenced by the user-file mappings or other DB
+// rows that are not stored.
+func (s *Server) fsckDangling(stored map[uint64]bool,
+	mappings []UserFileStoreItem) ([]FsckProblem, error) {
+	fileIDs := make([]int64, 0, len(mappings))
+	for i := range mappings {
+		fileIDs = append(fileIDs, mappings[i].FileID)
+	}
+	var records []FileRecord
+	if err := s.UserFileStore.All(&records); err != nil {
+		return nil, err
+	}
+	for i := range records {
+		fileIDs = append(fileIDs, records[i].FileID)
+	}
+	var grants []FileGrant
+	if err := s.UserFileStore.All(&grants); err != nil {
+		return nil, err
+	}
+	for i := range grants {
+		fileIDs = append(fileIDs, grants[i].FileID)
+	}
+	var links []ShareLink
+	if err := s.UserFileStore.All(&links); err != nil {
+		return nil, err
+	}
+	for i := range links {
+		fileIDs = append(fileIDs, links[i].FileID)
+	}
+
+	var problems []FsckProblem
+	seen := make(map[uint64]bool)
+	for _, fileID := range fileIDs {
+		uid := uint64(fileID)
+		if stored[uid] || seen[uid] {
+			continue
+		}
+		seen[uid] = true
+		problems = append(problems, FsckProblem{
+			Kind:   FsckDangling,
+			Name:   fmt.Sprintf("%016x", uid),
+			Detail: "DB rows refer to a file that is not stored",
+		})
+	}
+	return problems, nil
+}
+
+// deleteFileRows deletes all DB rows for the file with the given UID.
+func (s *Server) deleteFileRows(UID string) error {
+	uid, err := parseUID(UID)
+	if err != nil {
+		return err
+	}
+	fileID := int64(uid)
+
+	tx, err := s.UserFileStore.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, kind := range []interface{}{&UserFileStoreItem{}, &FileGrant{}, &ShareLink{}} {
+		err = tx.Select(q.Eq("FileID", fileID)).Delete(kind)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+	}
+	for _, row := range []interface{}{&FileRecord{FileID: fileID}, &ScrubRecord{FileID: fileID}} {
+		err = tx.DeleteStruct(row)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// fsckQuarantine moves the stored file aside if the storage Backend supports
+// it, and describes the result.
+func (s *Server) fsckQuarantine(uid uint64) string {
+	quarantiner, ok := s.Storage.(storage.Quarantiner)
+	if !ok {
+		return storage.ErrQuarantineUnsupported.Error()
+	}
+	err := quarantiner.Quarantine(fmt.Sprintf("%016x", uid))
+	if err == storage.ErrQuarantineUnsupported {
+		return err.Error()
+	}
+	if err != nil {
+		return "quarantine failed: " + err.Error()
+	}
+	return "quarantined"
+}
+
+// RunPeriodicFsck starts checking the DB and storage with Fsck at the given
+// interval until Shutdown, logging any problems found.
+func (s *Server) RunPeriodicFsck(interval time.Duration, opts *FsckOptions) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.quit:
+				return
+			}
+			report, err := s.Fsck(opts)
+			if err != nil {
+				log.Errorf("Storage check failed: %v", err)
+				continue
+			}
+			for i := range report.Problems {
+				log.Warnf("Storage check: %v", &report.Problems[i])
+			}
+			log.Infof("Storage check found %d problems with %d files.",
+				len(report.Problems), report.Files)
+		}
+	}()
+}
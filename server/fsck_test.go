@@ -0,0 +1,147 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chappjc/webfiles/storage"
+
+	"github.com/OneOfOne/xxhash"
+)
+
+// storeTestFile stores data under its content hash, and maps it to user if user
+// is not empty. The UID is returned.
+func storeTestFile(t *testing.T, s *Server, user, name string, data []byte) string {
+	uid := xxhash.Checksum64(data)
+	UID := fmt.Sprintf("%016x", uid)
+	if _, err := s.Storage.Put(UID, storage.Metadata{Name: name}, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if user != "" {
+		if err := s.storeUserFileMapping(user, uid, name, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return UID
+}
+
+// findProblem finds the problem of the given kind with the given name.
+func findProblem(report *FsckReport, kind, name string) *FsckProblem {
+	for i := range report.Problems {
+		if p := &report.Problems[i]; p.Kind == kind && p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func TestFsckUnreadable(t *testing.T) {
+	flaky := &flakyBackend{Backend: storage.NewMemory()}
+	s, cleanup := newTestOfflineServer(t, flaky)
+	defer cleanup()
+
+	unreadable := storeTestFile(t, s, "alice", "a.txt", []byte("can not be read"))
+	if err := s.storeUserFileMapping("alice", 0x0123456789abcdef, "gone.txt", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file that can not be read is reported, and the repairs already made
+	// are reported with it.
+	flaky.err = errors.New("connection reset by peer")
+	report, err := s.Fsck(&FsckOptions{Verify: true, Repair: true})
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	if findProblem(report, FsckUnreadable, unreadable) == nil {
+		t.Errorf("unreadable file %s not reported: %v", unreadable, report.Problems)
+	}
+	if p := findProblem(report, FsckDangling, "0123456789abcdef"); p == nil ||
+		p.Action != "deleted rows" {
+		t.Errorf("dangling row not repaired: %v", report.Problems)
+	}
+	if len(report.Problems) != 2 {
+		t.Errorf("found problems %v, expected 2", report.Problems)
+	}
+}
+
+func TestFsckDisk(t *testing.T) {
+	root, err := ioutil.TempDir("", "webfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	disk, err := storage.NewDisk(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, cleanup := newTestOfflineServer(t, disk)
+	defer cleanup()
+
+	kept := storeTestFile(t, s, "alice", "kept.txt", []byte("kept"))
+	orphan := storeTestFile(t, s, "", "orphan.txt", []byte("no user has this"))
+	noName := storeTestFile(t, s, "", "noname.txt", []byte("NAME file removed"))
+	if err = os.Remove(filepath.Join(root, noName, "NAME")); err != nil {
+		t.Fatal(err)
+	}
+	const dangling = "0123456789abcdef"
+	if err = s.storeUserFileMapping("bob", 0x0123456789abcdef, "gone.txt", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct{ kind, name, action string }{
+		{FsckOrphan, orphan, "deleted"},
+		{FsckDangling, dangling, "deleted rows"},
+		{FsckDamaged, noName, "deleted"},
+	}
+	report, err := s.Fsck(&FsckOptions{Verify: true})
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	if report.Files != 2 {
+		t.Errorf("Fsck found %d files, expected 2", report.Files)
+	}
+	for _, e := range expected {
+		if p := findProblem(report, e.kind, e.name); p == nil || p.Action != "" {
+			t.Errorf("%s %s not reported unchanged: %v", e.kind, e.name, report.Problems)
+		}
+	}
+	if len(report.Problems) != len(expected) {
+		t.Errorf("found problems %v, expected %d", report.Problems, len(expected))
+	}
+
+	// Repair removes the orphan, the folder with no NAME file, and the
+	// dangling rows, and keeps the intact file.
+	report, err = s.Fsck(&FsckOptions{Verify: true, Repair: true})
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	for _, e := range expected {
+		if p := findProblem(report, e.kind, e.name); p == nil || p.Action != e.action {
+			t.Errorf("%s %s not repaired: %v", e.kind, e.name, report.Problems)
+		}
+	}
+	for _, name := range []string{orphan, noName} {
+		if _, err = os.Stat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Errorf("folder %s not removed: %v", name, err)
+		}
+	}
+	if _, err = disk.Stat(kept); err != nil {
+		t.Errorf("intact file %s: %v", kept, err)
+	}
+
+	report, err = s.Fsck(&FsckOptions{Verify: true})
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	if len(report.Problems) != 0 {
+		t.Errorf("found problems %v after repair", report.Problems)
+	}
+}
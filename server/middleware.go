@@ -7,7 +7,6 @@ import (
 	"context"
 	"net/http"
 	"os"
-	"strconv"
 
 	"github.com/chappjc/webfiles/middleware"
 
@@ -31,30 +30,39 @@ func (s *Server) WithSession(next http.Handler) http.Handler {
 	})
 }
 
-// WithUserFileAuthz checks the permission of CtxUser for the file being accessed.
+// WithUserFileAuthz checks the permission of CtxUser for the file being
+// accessed, identified by the "{fileid}" URL path parameter. Users may access
+// files they uploaded or that were shared with them. If the user is not
+// permitted to access the file, the request is refused with 403 Forbidden,
+// or 404 Not Found if the file does not exist or HideFileExistence is set.
 func (s *Server) WithUserFileAuthz(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Lookup files associated with this user
 		user := middleware.RequestCtxUser(r)
-		userFileIDs, err := s.retrieveFileIDsByUser(user)
-		if err != nil {
-			log.Infof("failed to retrieve file UIDs for user %s (no files uploaded?): %v", user, err)
-			next.ServeHTTP(w, r)
-			return
-		}
 
 		// Extract the file's unique id from the path
 		fileID := chi.URLParam(r, "fileid")
-		uid, err := strconv.ParseUint(fileID, 16, 64)
+		uid, err := parseUID(fileID)
 		if err != nil {
-			log.Errorf("failed to decode UID %s: %v", fileID, err)
-			next.ServeHTTP(w, r)
+			log.Debugf("Invalid UID %s: %v", fileID, err)
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
 		}
 
-		for _, id := range userFileIDs {
-			if id == int64(uid) {
-				break
-			}
+		status, err := s.fileAccessStatus(user, uid)
+		if err != nil {
+			log.Errorf("Failed to check access to file %s for user %s: %v", fileID, user, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+		if status == http.StatusGone {
+			http.Error(w, "file expired", status)
+			return
+		}
+		if status != http.StatusOK {
+			log.Infof("User %s denied access to file %s.", user, fileID)
+			s.refuseFileAccess(w, uid)
+			return
 		}
 
 		ctx := context.WithValue(r.Context(), middleware.CtxAuthzed, true)
@@ -62,6 +70,20 @@ func (s *Server) WithUserFileAuthz(next http.Handler) http.Handler {
 	})
 }
 
+// WithAdmin permits only the AdminUsers to make the request. Other users are
+// refused with 403 Forbidden.
+func (s *Server) WithAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.RequestCtxUser(r)
+		if !s.AdminUsers[user] {
+			log.Infof("User %s denied access to %s.", user, r.URL.Path)
+			http.Error(w, "admin access required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // WithJWTCookie injects a new or existing cookie-managed JWT into the request
 // context. The signed token and the session are both embedded.
 func (s *Server) WithJWTCookie(next http.Handler) http.Handler {
@@ -150,10 +172,19 @@ func (s *Server) WithJWTCookie(next http.Handler) http.Handler {
 			r.AddCookie(sessions.NewCookie("jwt", token, jwtCookie.Options))
 		}
 
+		// The user is identified by the token, which is not necessarily the
+		// one generated for this session.
+		user := middleware.TokenUser(JWToken)
+		if user == "" {
+			log.Errorf("JWT has no user claim")
+			http.Error(w, "invalid JWT", http.StatusBadRequest)
+			return
+		}
+
 		// Inject session and JWT in request context.
 		ctx := context.WithValue(r.Context(), middleware.CtxJWTCookie, jwtCookie)
 		ctx = context.WithValue(ctx, middleware.CtxToken, token)
-		ctx = context.WithValue(ctx, middleware.CtxUser, jwtCookie.ID)
+		ctx = context.WithValue(ctx, middleware.CtxUser, user)
 		ctx = jwtauth.NewContext(ctx, JWToken, errParse)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -0,0 +1,127 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chappjc/webfiles/middleware"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestWithUserFileAuthz(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	router := NewRouter(s)
+
+	content := []byte("owned by alice")
+	upload, err := s.storeUpload("alice", "alice.txt", bytes.NewReader(content), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := func(user string) string {
+		tok, _, err := middleware.NewSignedJWT(s.SigningKey, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	// An expired token for the owner must not be accepted.
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user": "alice",
+		"exp":  time.Now().Add(-time.Hour).Unix(),
+		"iat":  time.Now().Add(-2 * time.Hour).Unix(),
+	}).SignedString([]byte(s.SigningKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		uid    string
+		token  string
+		hide   bool
+		status int
+	}{
+		{"owner", upload.UID, token("alice"), false, http.StatusOK},
+		{"other user", upload.UID, token("bob"), false, http.StatusForbidden},
+		{"new session", upload.UID, "", false, http.StatusForbidden},
+		{"expired owner token", upload.UID, expired, false, http.StatusForbidden},
+		{"missing file", "0123456789abcdef", token("alice"), false, http.StatusNotFound},
+		{"invalid UID", "notauid", token("alice"), false, http.StatusNotFound},
+		{"hidden owner", upload.UID, token("alice"), true, http.StatusOK},
+		{"hidden other user", upload.UID, token("bob"), true, http.StatusNotFound},
+		{"hidden missing file", "0123456789abcdef", token("bob"), true, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		s.HideFileExistence = tt.hide
+		url := "/file/" + tt.uid
+		if tt.token != "" {
+			url += "?jwt=" + tt.token
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d", tt.name, rec.Code, tt.status)
+			continue
+		}
+		if rec.Code == http.StatusOK && !bytes.Equal(rec.Body.Bytes(), content) {
+			t.Errorf("%s: got %q, expected %q", tt.name, rec.Body.Bytes(), content)
+		}
+	}
+}
+
+func TestWithJWTCookie(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	router := NewRouter(s)
+
+	get := func(url string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", url, rec.Code)
+		}
+		return rec
+	}
+
+	// A request with no token starts a session with a new token.
+	rec := get("/token", nil)
+	token := rec.Body.String()
+	Token, err := middleware.JWTParse(token, s.SigningKey)
+	if err != nil || !Token.Valid {
+		t.Fatalf("new session: invalid token %q: %v", token, err)
+	}
+	if middleware.TokenUser(Token) == "" {
+		t.Error("new session: token has no user")
+	}
+
+	// The session cookie keeps the same token.
+	cookies := (&http.Response{Header: rec.Header()}).Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("new session: no session cookie set")
+	}
+	if got := get("/token", cookies).Body.String(); got != token {
+		t.Errorf("session cookie: token %q, expected %q", got, token)
+	}
+
+	// A valid token in the query is used instead of the session's token.
+	tok, _, err := middleware.NewSignedJWT(s.SigningKey, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := get("/token?jwt="+tok, cookies).Body.String(); got != tok {
+		t.Errorf("query token: token %q, expected %q", got, tok)
+	}
+}
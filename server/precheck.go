@@ -0,0 +1,287 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chappjc/webfiles/middleware"
+	"github.com/chappjc/webfiles/response"
+	"github.com/chappjc/webfiles/storage"
+
+	"github.com/asdine/storm"
+)
+
+const (
+	// possessionHMACDomain separates the signatures of proof-of-possession
+	// challenges.
+	possessionHMACDomain = "webfiles possession challenge v1"
+	// possessionChallengeLifetime is how long a client has to answer a
+	// challenge.
+	possessionChallengeLifetime = 5 * time.Minute
+	// possessionRangeLen is the length of the byte range that a client must
+	// hash to prove possession of a file, or the whole file if it is smaller.
+	possessionRangeLen = 64 << 10
+	// possessionNonceLen is the length of the random nonce that is hashed
+	// with the byte range.
+	possessionNonceLen = 16
+	// possessionChallengeLen is the length of the decoded challenge: the
+	// file's SHA-256 digest, size, range offset, range length, expiry, nonce,
+	// and MAC.
+	possessionChallengeLen = sha256.Size + 4*8 + possessionNonceLen + sha256.Size
+)
+
+// possessionChallenge is a request for a client to prove that it has a file by
+// hashing a random byte range of it. The file is identified by the SHA-256
+// digest and size provided by the client, rather than the UID, so that the
+// challenge does not reveal whether the file is stored. The challenge is signed
+// with the server's signing key, so it need not be stored.
+type possessionChallenge struct {
+	digest  []byte
+	size    int64
+	offset  int64
+	length  int64
+	expires int64
+	nonce   []byte
+}
+
+// encode serializes the challenge, without the MAC.
+func (c *possessionChallenge) encode() []byte {
+	b := make([]byte, sha256.Size+4*8, possessionChallengeLen)
+	copy(b, c.digest)
+	binary.BigEndian.PutUint64(b[sha256.Size:], uint64(c.size))
+	binary.BigEndian.PutUint64(b[sha256.Size+8:], uint64(c.offset))
+	binary.BigEndian.PutUint64(b[sha256.Size+16:], uint64(c.length))
+	binary.BigEndian.PutUint64(b[sha256.Size+24:], uint64(c.expires))
+	return append(b, c.nonce...)
+}
+
+// possessionMAC computes the HMAC-SHA256 of the encoded challenge and the user
+// it was issued to, so that it may not be answered by another user.
+func (s *Server) possessionMAC(user string, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(s.SigningKey))
+	mac.Write([]byte(possessionHMACDomain))
+	mac.Write([]byte(user))
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// newPossessionChallenge creates a challenge for a random byte range of the
+// file with the given SHA-256 digest and size.
+func newPossessionChallenge(digest []byte, size int64) (*possessionChallenge, error) {
+	c := &possessionChallenge{
+		digest:  digest,
+		size:    size,
+		length:  size,
+		expires: time.Now().Add(possessionChallengeLifetime).Unix(),
+		nonce:   make([]byte, possessionNonceLen),
+	}
+	if _, err := rand.Read(c.nonce); err != nil {
+		return nil, err
+	}
+	if size > possessionRangeLen {
+		c.length = possessionRangeLen
+		offset, err := rand.Int(rand.Reader, big.NewInt(size-c.length+1))
+		if err != nil {
+			return nil, err
+		}
+		c.offset = offset.Int64()
+	}
+	return c, nil
+}
+
+// signPossessionChallenge returns the signed challenge, base64 encoded, for the
+// client to return with its proof.
+func (s *Server) signPossessionChallenge(user string, c *possessionChallenge) string {
+	b := c.encode()
+	b = append(b, s.possessionMAC(user, b)...)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// verifyPossessionChallenge decodes a challenge returned by the client, and
+// checks that it was issued to the user and has not expired.
+func (s *Server) verifyPossessionChallenge(user, challenge string) (*possessionChallenge, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(challenge)
+	if err != nil || len(b) != possessionChallengeLen {
+		return nil, false
+	}
+	msg, mac := b[:len(b)-sha256.Size], b[len(b)-sha256.Size:]
+	if !hmac.Equal(mac, s.possessionMAC(user, msg)) {
+		return nil, false
+	}
+	c := &possessionChallenge{
+		digest:  msg[:sha256.Size],
+		size:    int64(binary.BigEndian.Uint64(msg[sha256.Size:])),
+		offset:  int64(binary.BigEndian.Uint64(msg[sha256.Size+8:])),
+		length:  int64(binary.BigEndian.Uint64(msg[sha256.Size+16:])),
+		expires: int64(binary.BigEndian.Uint64(msg[sha256.Size+24:])),
+		nonce:   msg[sha256.Size+32:],
+	}
+	return c, time.Now().Unix() < c.expires
+}
+
+// possessionProof computes the expected proof for the challenge: the SHA-256
+// digest of the nonce followed by the challenged byte range of the stored file
+// with the given UID.
+func (s *Server) possessionProof(c *possessionChallenge, uid uint64) ([]byte, error) {
+	f, _, err := s.openStoredFile(uid)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err = f.Seek(c.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write(c.nonce)
+	if _, err = io.CopyN(h, f, c.length); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// UploadPrecheck is the handler for POST requests to check if a file is
+// already stored before uploading it, with the form values "sha256", the hex
+// encoded SHA-256 digest of the file, and "size", its length in bytes. The
+// response is a challenge to prove possession of the file by hashing a random
+// byte range of it, which is answered with UploadClaim instead of uploading the
+// file. A challenge is issued whether or not the file is stored, so that users
+// cannot learn which files others have stored, and it may not be answered if
+// the file is not stored. The file should then be uploaded.
+func (s *Server) UploadPrecheck(w http.ResponseWriter, r *http.Request) {
+	digest := strings.ToLower(r.FormValue("sha256"))
+	sum, err := hex.DecodeString(digest)
+	if err != nil || len(sum) != sha256.Size {
+		http.Error(w, "invalid SHA-256 digest", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "invalid size", http.StatusBadRequest)
+		return
+	}
+
+	c, err := newPossessionChallenge(sum, size)
+	if err != nil {
+		log.Errorf("Failed to create possession challenge: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.WriteJSON(w, &response.PossessionChallenge{
+		Challenge: s.signPossessionChallenge(middleware.RequestCtxUser(r), c),
+		Offset:    c.offset,
+		Length:    c.length,
+		Nonce:     hex.EncodeToString(c.nonce),
+		Expires:   c.expires,
+	}, "    ")
+}
+
+// UploadClaim is the handler for POST requests answering a challenge from
+// UploadPrecheck, with the form values "challenge", as issued, and "proof", the
+// hex encoded SHA-256 digest of the nonce followed by the challenged byte range
+// of the file. If the proof is correct, the file is associated with the user as
+// if it were uploaded. The optional form values "name", the file name, and
+// "expires_in" or "expires_at" are as for UploadFile.
+func (s *Server) UploadClaim(w http.ResponseWriter, r *http.Request) {
+	user := middleware.RequestCtxUser(r)
+	c, ok := s.verifyPossessionChallenge(user, r.FormValue("challenge"))
+	if !ok {
+		http.Error(w, "invalid or expired challenge", http.StatusBadRequest)
+		return
+	}
+	proof, err := hex.DecodeString(r.FormValue("proof"))
+	if err != nil {
+		http.Error(w, "invalid proof", http.StatusBadRequest)
+		return
+	}
+	expires, err := parseExpiry(r.FormValue("expires_in"), r.FormValue("expires_at"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The same response is given whether the file is not stored or the
+	// proof is incorrect.
+	rec, err := s.fileRecordBySHA256(hex.EncodeToString(c.digest), c.size)
+	var expected []byte
+	if err == nil && rec != nil {
+		expected, err = s.possessionProof(c, uint64(rec.FileID))
+	}
+	if err != nil && err != storage.ErrNotFound && err != io.EOF {
+		log.Errorf("Failed to compute possession proof: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rec == nil || expected == nil || !hmac.Equal(proof, expected) {
+		http.Error(w, "proof of possession failed", http.StatusForbidden)
+		return
+	}
+
+	// The file may have been deleted since the proof was computed.
+	s.fileMtx.Lock()
+	defer s.fileMtx.Unlock()
+	uid := uint64(rec.FileID)
+	UID := fmt.Sprintf("%016x", uid)
+	if rec, err = s.fileRecordBySHA256(rec.SHA256, rec.Size); err != nil || rec == nil {
+		if err == nil {
+			http.Error(w, "proof of possession failed", http.StatusForbidden)
+			return
+		}
+		log.Errorf("Failed to retrieve record for file %s: %v", UID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := rec.Name
+	if v := r.FormValue("name"); v != "" {
+		name = filepath.Base(v)
+	}
+	if err = s.storeUserFileMapping(user, uid, name, expires); err != nil {
+		log.Errorf("Failed to store user-file mapping [%s,%d]: %v", user, uid, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("User %s claimed file %s by proof of possession.", user, UID)
+	upload := response.Upload{
+		UID:         UID,
+		FileName:    name,
+		Size:        rec.Size,
+		ContentType: rec.ContentType,
+		SHA256:      rec.SHA256,
+		Expires:     expires,
+	}
+	response.WriteJSON(w, &response.UploadResponse{
+		Upload: upload,
+		Files:  []response.Upload{upload},
+		Token:  middleware.RequestCtxToken(r),
+	}, "    ")
+}
+
+// fileRecordBySHA256 retrieves the record of the stored file with the given hex
+// encoded SHA-256 digest and size. A nil *FileRecord is returned if there is no
+// such file.
+func (s *Server) fileRecordBySHA256(digest string, size int64) (*FileRecord, error) {
+	var rec FileRecord
+	err := s.UserFileStore.One("SHA256", digest, &rec)
+	if err == storm.ErrNotFound || (err == nil && rec.Size != size) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
@@ -49,7 +49,46 @@ func NewRouter(server *Server) WebMux {
 	mux.Get("/", server.root)
 	mux.Get("/token", server.Token)
 	mux.HandleFunc("/upload", server.UploadFile)
+	mux.With(middleware.JWTAuthenticator).Post("/upload/precheck", server.UploadPrecheck)
+	mux.With(middleware.JWTAuthenticator).Post("/upload/claim", server.UploadClaim)
+	mux.Route("/uploads/tus", func(r chi.Router) {
+		r.Use(WithTusResumable)
+		r.Options("/", server.TusOptions)
+		r.Options("/{uploadid}", server.TusOptions)
+		r.With(middleware.JWTAuthenticator).Post("/", server.TusCreate)
+		r.With(middleware.JWTAuthenticator).Head("/{uploadid}", server.TusHead)
+		r.With(middleware.JWTAuthenticator).Patch("/{uploadid}", server.TusPatch)
+		r.With(middleware.JWTAuthenticator).Delete("/{uploadid}", server.TusDelete)
+	})
 	mux.With(middleware.JWTAuthenticator, server.WithUserFileAuthz).Get("/file/{fileid}", server.File)
+	mux.With(middleware.JWTAuthenticator, server.WithUserFileAuthz).Head("/file/{fileid}", server.File)
+	mux.With(middleware.JWTAuthenticator).Delete("/file/{fileid}", server.DeleteFile)
+	mux.Route("/file/{fileid}/grants", func(r chi.Router) {
+		r.Use(middleware.JWTAuthenticator)
+		r.Get("/", server.FileGrants)
+		r.Post("/", server.GrantFile)
+		r.Delete("/{grantee}", server.RevokeFileGrant)
+	})
+	mux.Route("/file/{fileid}/links", func(r chi.Router) {
+		r.Use(middleware.JWTAuthenticator)
+		r.Get("/", server.ShareLinks)
+		r.Post("/", server.CreateShareLink)
+		r.Delete("/{linkid}", server.RevokeShareLink)
+	})
 	mux.With(middleware.JWTAuthenticator).Get("/user-files", server.FileList)
+	mux.With(middleware.JWTAuthenticator).Get("/by-hash/sha256/{hash}", server.FileBySHA256)
+	mux.With(middleware.JWTAuthenticator).Head("/by-hash/sha256/{hash}", server.FileBySHA256)
+	mux.Route("/trash", func(r chi.Router) {
+		r.Use(middleware.JWTAuthenticator)
+		r.Get("/", server.Trash)
+		r.Post("/{fileid}/restore", server.RestoreFile)
+	})
+	mux.Route("/admin", func(r chi.Router) {
+		r.Use(middleware.JWTAuthenticator, server.WithAdmin)
+		r.Get("/scrub", server.ScrubStatus)
+	})
+	mux.Get("/s/{token}", server.SharedFile)
+	mux.Head("/s/{token}", server.SharedFile)
+	mux.Post("/s/{token}", server.UnlockSharedFile)
 	return WebMux{mux}
 }
@@ -0,0 +1,387 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chappjc/webfiles/response"
+	"github.com/chappjc/webfiles/storage"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+)
+
+// scrubPollInterval is the longest time the scrubber waits before looking for
+// files that are due to be checked.
+const scrubPollInterval = time.Hour
+
+var (
+	// errFileCorrupt is the error returned for a file that the scrubber found
+	// corrupt.
+	errFileCorrupt = errors.New("stored file is corrupt")
+
+	// errScrubStopped is returned when the scrubber is stopped by Shutdown
+	// while checking a file.
+	errScrubStopped = errors.New("scrubber stopped")
+)
+
+// ScrubRecord is the type in the storm user-file DB recording the result of the
+// last integrity check of a stored file. Corrupt is set if the file's contents
+// did not match its UID or recorded digest, or failed an integrity check while
+// being read, and Detail describes the failure.
+type ScrubRecord struct {
+	FileID  int64 `storm:"id"`
+	Checked time.Time
+	Corrupt bool `storm:"index"`
+	Detail  string
+}
+
+// scrubState is the configuration and progress of the scrubber. A run checks
+// each file that is due, and the counts are of the current or last run.
+type scrubState struct {
+	interval time.Duration
+	rate     int64
+
+	mtx       sync.Mutex
+	running   bool
+	started   time.Time
+	completed time.Time
+	files     int64
+	bytes     int64
+}
+
+// rateLimit limits the rate at which files are read, until quit is closed.
+type rateLimit struct {
+	// bytesPerSec is the read rate, or zero for no limit.
+	bytesPerSec int64
+	quit        <-chan struct{}
+}
+
+// throttledReader is an io.Reader that delays after each Read so that data is
+// read no faster than the rateLimit.
+type throttledReader struct {
+	r     io.Reader
+	limit *rateLimit
+}
+
+// Read reads from the underlying Reader, and then waits until the data is
+// permitted by the rate limit. errScrubStopped is returned if quit is closed
+// while waiting.
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 && t.limit.bytesPerSec > 0 {
+		delay := time.Duration(n) * time.Second / time.Duration(t.limit.bytesPerSec)
+		select {
+		case <-time.After(delay):
+		case <-t.limit.quit:
+			return n, errScrubStopped
+		}
+	}
+	return n, err
+}
+
+// reader returns r, throttled to the rate limit if l is not nil.
+func (l *rateLimit) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &throttledReader{r: r, limit: l}
+}
+
+// integrityError checks if err, from opening or reading a stored file, shows
+// that the file's data is corrupt, as when a hash, checksum, or authentication
+// tag does not match, rather than that it could not be read.
+func integrityError(err error) bool {
+	switch err.(type) {
+	case *storage.CorruptError, flate.CorruptInputError:
+		return true
+	}
+	return err == gzip.ErrChecksum || err == gzip.ErrHeader
+}
+
+// verifyStoredFile rehashes the stored file, and compares the result with its
+// recorded size and SHA-256 digest, or for files stored before digests were
+// recorded, its UID. If the file does not match, or fails an integrity check of
+// the storage Backend or compression, the problem is described. An empty
+// description is returned if the file matches or is no longer stored. Other
+// errors opening or reading the file, which may be transient, are returned
+// rather than described. The file is read no faster than limit, if it is not
+// nil, and the number of bytes read is returned.
+func (s *Server) verifyStoredFile(uid uint64, limit *rateLimit) (string, int64, error) {
+	var rec FileRecord
+	err := s.UserFileStore.One("FileID", int64(uid), &rec)
+	if err != nil && err != storm.ErrNotFound {
+		return "", 0, err
+	}
+
+	file, _, err := s.openStoredFile(uid)
+	if err == storage.ErrNotFound {
+		return "", 0, nil
+	}
+	if err != nil {
+		if integrityError(err) {
+			return "failed to open file: " + err.Error(), 0, nil
+		}
+		return "", 0, err
+	}
+	defer file.Close()
+	hasher := s.newHasher()
+	sha256Hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(hasher, sha256Hasher), limit.reader(file))
+	if err != nil {
+		if integrityError(err) {
+			return "failed to read file: " + err.Error(), size, nil
+		}
+		return "", size, err
+	}
+
+	if rec.SHA256 != "" {
+		if digest := hex.EncodeToString(sha256Hasher.Sum(nil)); digest != rec.SHA256 {
+			return fmt.Sprintf("SHA-256 digest %s, recorded %s", digest, rec.SHA256),
+				size, nil
+		}
+		if size != rec.Size {
+			return fmt.Sprintf("size %d, recorded %d", size, rec.Size), size, nil
+		}
+		return "", size, nil
+	}
+	if sum := hasher.Sum64(); sum != uid {
+		return fmt.Sprintf("content hash %016x", sum), size, nil
+	}
+	return "", size, nil
+}
+
+// fileCorrupt checks if the scrubber found the file with the given UID corrupt.
+func (s *Server) fileCorrupt(uid uint64) (bool, error) {
+	var rec ScrubRecord
+	err := s.UserFileStore.One("FileID", int64(uid), &rec)
+	if err == storm.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return rec.Corrupt, nil
+}
+
+// clearScrubFailure removes the scrub record of the file with the given UID,
+// after the file is stored again, so that it is no longer considered corrupt.
+func (s *Server) clearScrubFailure(uid uint64) {
+	err := s.UserFileStore.DeleteStruct(&ScrubRecord{FileID: int64(uid)})
+	if err != nil && err != storm.ErrNotFound {
+		log.Errorf("Failed to clear scrub record of file %016x: %v", uid, err)
+	}
+}
+
+// recordScrub records the result of checking the file with the given UID,
+// unless it was deleted while it was checked. detail describes the problem
+// found, or is empty if the file is intact.
+func (s *Server) recordScrub(uid uint64, detail string) error {
+	s.fileMtx.Lock()
+	defer s.fileMtx.Unlock()
+
+	UID := fmt.Sprintf("%016x", uid)
+	if _, err := s.Storage.Stat(UID); err == storage.ErrNotFound {
+		return nil
+	}
+
+	var prev ScrubRecord
+	err := s.UserFileStore.One("FileID", int64(uid), &prev)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	switch {
+	case detail != "":
+		log.Errorf("Integrity check failed for file %s: %s", UID, detail)
+	case prev.Corrupt:
+		log.Infof("File %s, previously found corrupt, passed its integrity check.", UID)
+	}
+	return s.UserFileStore.Save(&ScrubRecord{
+		FileID:  int64(uid),
+		Checked: time.Now(),
+		Corrupt: detail != "",
+		Detail:  detail,
+	})
+}
+
+// dueForScrub lists the UIDs of the stored files that have not been checked
+// within the scrub interval, least recently checked first.
+func (s *Server) dueForScrub() ([]uint64, error) {
+	list, err := s.Storage.List()
+	if err != nil {
+		return nil, err
+	}
+	var records []ScrubRecord
+	if err = s.UserFileStore.All(&records); err != nil {
+		return nil, err
+	}
+	checked := make(map[uint64]time.Time, len(records))
+	for i := range records {
+		checked[uint64(records[i].FileID)] = records[i].Checked
+	}
+
+	cutoff := time.Now().Add(-s.scrub.interval)
+	var due []uint64
+	for _, UID := range list {
+		uid, err := strconv.ParseUint(UID, 16, 64)
+		if err != nil || len(UID) != 16 {
+			continue
+		}
+		if checked[uid].Before(cutoff) {
+			due = append(due, uid)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return checked[due[i]].Before(checked[due[j]])
+	})
+	return due, nil
+}
+
+// scrubDue checks each file that is due to be checked, recording the results.
+func (s *Server) scrubDue() error {
+	due, err := s.dueForScrub()
+	if err != nil || len(due) == 0 {
+		return err
+	}
+
+	st := s.scrub
+	st.mtx.Lock()
+	st.running = true
+	st.started = time.Now()
+	st.files, st.bytes = 0, 0
+	st.mtx.Unlock()
+	defer func() {
+		st.mtx.Lock()
+		st.running = false
+		st.mtx.Unlock()
+	}()
+
+	// A file that can not be read is checked again when the scrubber next
+	// looks for files that are due.
+	limit := &rateLimit{bytesPerSec: st.rate, quit: s.quit}
+	var failures, skipped int
+	for _, uid := range due {
+		detail, n, err := s.verifyStoredFile(uid, limit)
+		if err == errScrubStopped {
+			return err
+		}
+		if err != nil {
+			log.Warnf("Failed to check file %016x, will retry: %v", uid, err)
+			skipped++
+			continue
+		}
+		if err = s.recordScrub(uid, detail); err != nil {
+			return err
+		}
+		if detail != "" {
+			failures++
+		}
+		st.mtx.Lock()
+		st.files++
+		st.bytes += n
+		st.mtx.Unlock()
+	}
+
+	st.mtx.Lock()
+	st.completed = time.Now()
+	log.Infof("Integrity check of %d files (%d bytes) found %d corrupt files. "+
+		"%d files could not be read.", st.files, st.bytes, failures, skipped)
+	st.mtx.Unlock()
+	return nil
+}
+
+// RunScrubber starts checking the integrity of stored files in the background
+// until Shutdown. Each file is rehashed once per interval, reading no more
+// than bytesPerSec bytes per second, or without limit if bytesPerSec is zero.
+// Files that fail their check are logged, recorded in the DB, and refused
+// when requested until they pass a later check or are uploaded again.
+func (s *Server) RunScrubber(interval time.Duration, bytesPerSec int64) {
+	s.scrub = &scrubState{
+		interval: interval,
+		rate:     bytesPerSec,
+	}
+	s.wg.Add(1)
+	go s.scrubber()
+}
+
+// scrubber periodically checks the files that are due until Shutdown.
+func (s *Server) scrubber() {
+	defer s.wg.Done()
+	poll := s.scrub.interval
+	if poll > scrubPollInterval {
+		poll = scrubPollInterval
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		if err := s.scrubDue(); err != nil {
+			if err == errScrubStopped {
+				return
+			}
+			log.Errorf("Integrity check failed: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// ScrubStatus is the admin handler describing the progress of the integrity
+// scrubber and the files it found corrupt.
+func (s *Server) ScrubStatus(w http.ResponseWriter, r *http.Request) {
+	status := response.ScrubStatus{
+		CorruptFiles: []response.CorruptFile{},
+	}
+	if st := s.scrub; st != nil {
+		status.Enabled = true
+		status.Interval = st.interval.String()
+		status.RateLimit = st.rate
+		st.mtx.Lock()
+		status.Running = st.running
+		status.Started = unixTime(st.started)
+		status.Completed = unixTime(st.completed)
+		status.FilesChecked = st.files
+		status.BytesChecked = st.bytes
+		st.mtx.Unlock()
+	}
+
+	var records []ScrubRecord
+	err := s.UserFileStore.Select(q.Eq("Corrupt", true)).Find(&records)
+	if err != nil && err != storm.ErrNotFound {
+		log.Errorf("Failed to retrieve scrub records: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	for i := range records {
+		status.CorruptFiles = append(status.CorruptFiles, response.CorruptFile{
+			UID:     fmt.Sprintf("%016x", uint64(records[i].FileID)),
+			Detail:  records[i].Detail,
+			Checked: records[i].Checked.Unix(),
+		})
+	}
+	response.WriteJSON(w, status, "    ")
+}
+
+// unixTime converts t to a Unix timestamp, or zero if t is the zero Time.
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
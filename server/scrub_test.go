@@ -0,0 +1,81 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/chappjc/webfiles/storage"
+)
+
+// flakyBackend is a storage Backend whose Get fails with err, if it is set.
+type flakyBackend struct {
+	storage.Backend
+	err error
+}
+
+func (f *flakyBackend) Get(uid string) (storage.File, *storage.FileInfo, error) {
+	if f.err != nil {
+		return nil, nil, f.err
+	}
+	return f.Backend.Get(uid)
+}
+
+func TestScrubReadErrors(t *testing.T) {
+	mem := storage.NewMemory()
+	flaky := &flakyBackend{Backend: mem}
+	s, cleanup := newTestOfflineServer(t, flaky)
+	defer cleanup()
+	s.scrub = &scrubState{interval: time.Hour}
+	s.DisableCompression = true
+
+	data := []byte("checked by the scrubber")
+	up, err := s.storeUpload("alice", "a.txt", bytes.NewReader(data), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, err := parseUID(up.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := func() bool {
+		c, err := s.fileCorrupt(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// A file that can not be read is not marked corrupt, and is checked
+	// again.
+	flaky.err = errors.New("connection reset by peer")
+	if err = s.scrubDue(); err != nil {
+		t.Fatalf("scrubDue failed: %v", err)
+	}
+	if corrupt() {
+		t.Error("file marked corrupt after a read error")
+	}
+	if due, _ := s.dueForScrub(); len(due) != 1 {
+		t.Errorf("%d files due after a read error, expected 1", len(due))
+	}
+
+	// A file that does not match its digest is marked corrupt.
+	flaky.err = nil
+	info, err := mem.Stat(up.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mem.Put(up.UID, info.Metadata, bytes.NewReader([]byte("tampered"))); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.scrubDue(); err != nil {
+		t.Fatalf("scrubDue failed: %v", err)
+	}
+	if !corrupt() {
+		t.Error("file not marked corrupt after a digest mismatch")
+	}
+}
@@ -5,24 +5,31 @@ package server
 
 import (
 	"crypto/sha256"
-	"errors"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/asdine/storm/q"
 
 	"github.com/chappjc/webfiles/middleware"
 	"github.com/chappjc/webfiles/response"
+	"github.com/chappjc/webfiles/storage"
 
 	"github.com/OneOfOne/xxhash"
 	"github.com/asdine/storm"
+	bolt "github.com/coreos/bbolt"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/jwtauth"
 	"github.com/gorilla/sessions"
@@ -36,10 +43,18 @@ func UseLog(_log *logrus.Logger) {
 	log = _log
 }
 
-const (
-	defaultFilesPath = "uploads"
-	uploadPostParam  = "fileupload"
-)
+// DefaultFilesPath is the folder where files are stored on disk if no storage
+// Backend is given to NewServer.
+const DefaultFilesPath = "uploads"
+
+const defaultTusPath = "tus"
+
+// userFileDBPath is the path of the storm user-file DB.
+const userFileDBPath = "./userdb"
+
+// offlineDBTimeout is how long NewOfflineServer waits for the user-file DB to
+// be released by another process, such as a running server.
+const offlineDBTimeout = 5 * time.Second
 
 // Server manages cookies/auth, and implements the http handlers
 type Server struct {
@@ -47,9 +62,44 @@ type Server struct {
 	AuthToken     *jwtauth.JWTAuth
 	SigningKey    string
 	MaxFileSize   int64
-	FilesPath     string
+	Storage       storage.Backend
+	TusPath       string
 	Templates     *SiteTemplates
 	UserFileStore *storm.DB
+
+	// HideFileExistence causes requests for files that the user may not
+	// access to be refused with 404 Not Found rather than 403 Forbidden, so
+	// that users may not learn what files exist.
+	HideFileExistence bool
+	// TrashRetention is how long deleted files are kept in the trash before
+	// they are permanently deleted. If zero, files are deleted immediately.
+	TrashRetention time.Duration
+	// DisableCompression causes files to be stored as uploaded, even if they
+	// are of a compressible type. Compression prevents a deduplicating
+	// storage Backend from finding data shared by similar files.
+	DisableCompression bool
+	// AdminUsers are the users permitted to use the admin endpoints.
+	AdminUsers map[string]bool
+
+	tusMtx  sync.Mutex
+	tusBusy map[string]bool
+
+	// fileMtx serializes storing files and their user-file mappings with
+	// deleting files, so that a file is not deleted from storage after an
+	// upload of identical content but before its mapping is stored.
+	fileMtx sync.Mutex
+
+	// newHasher creates the hash used to compute file UIDs. It may be
+	// replaced, e.g. to force collisions.
+	newHasher func() hash.Hash64
+
+	// scrub is the status of the integrity scrubber, or nil if it is not
+	// running.
+	scrub *scrubState
+
+	// quit signals the background goroutines to stop, and wg waits for them.
+	quit chan struct{}
+	wg   sync.WaitGroup
 }
 
 // UserFileStoreItem is the type in the storm user-file DB.
@@ -57,12 +107,49 @@ type UserFileStoreItem struct {
 	RowID  int    `storm:"id,increment"`
 	User   string `storm:"index"`
 	FileID int64  `storm:"index"`
+
+	// Name is the file name given by the user when uploading the file. Since
+	// identical files uploaded by different users share a UID, each user's
+	// file name is recorded here rather than with the stored file.
+	Name string
+	// DeletedAt is the Unix time when the file was moved to the user's trash,
+	// or zero if the file is not in the trash.
+	DeletedAt int64
+	// Expires is the Unix time after which the file is deleted, or zero if
+	// the file does not expire.
+	Expires int64
+}
+
+// activeMapping matches the user-file mappings of files that are neither in the
+// trash nor expired.
+func activeMapping() q.Matcher {
+	return q.And(q.Eq("DeletedAt", int64(0)),
+		q.Or(q.Eq("Expires", int64(0)), q.Gt("Expires", time.Now().Unix())))
+}
+
+// expiredMapping matches the user-file mappings of expired files that are not
+// in the trash.
+func expiredMapping() q.Matcher {
+	return q.And(q.Eq("DeletedAt", int64(0)), q.Gt("Expires", int64(0)),
+		q.Lte("Expires", time.Now().Unix()))
 }
 
 // NewServer creates a new Server for the given signing secret, cookie storage
-// file system path, and uploaded file size limit.
-func NewServer(secret, cookieStorePath string, maxFileSize int64) (*Server, error) {
-	userFileDB, err := storm.Open("./userdb")
+// file system path, uploaded file size limit, file storage Backend, and trash
+// retention period. If store is nil, files are stored on disk in the "uploads"
+// folder. The trash janitor, tus upload janitor, expiry sweeper, and storage
+// garbage collector are started, and are stopped by Shutdown.
+func NewServer(secret, cookieStorePath string, maxFileSize int64, store storage.Backend,
+	trashRetention time.Duration) (*Server, error) {
+	if store == nil {
+		disk, err := storage.NewDisk(DefaultFilesPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create file storage: %v", err)
+		}
+		store = disk
+	}
+
+	userFileDB, err := storm.Open(userFileDBPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed storm.Open: %v", err)
 	}
@@ -73,8 +160,14 @@ func NewServer(secret, cookieStorePath string, maxFileSize int64) (*Server, erro
 		CookieStore:   sessions.NewFilesystemStore(cookieStorePath, shaSum[:]),
 		AuthToken:     jwtauth.New("HS256", []byte(secret), nil),
 		MaxFileSize:   maxFileSize,
-		FilesPath:     defaultFilesPath,
+		Storage:       store,
+		TusPath:       defaultTusPath,
 		UserFileStore: userFileDB,
+		tusBusy:       make(map[string]bool),
+		newHasher:     func() hash.Hash64 { return xxhash.New64() },
+		quit:          make(chan struct{}),
+
+		TrashRetention: trashRetention,
 	}
 
 	opts := server.CookieStore.Options
@@ -82,43 +175,166 @@ func NewServer(secret, cookieStorePath string, maxFileSize int64) (*Server, erro
 	opts.HttpOnly = true
 	opts.Secure = false // for HTTPS-only, set true
 
-	templateNames := []string{"root"}
+	templateNames := []string{"root", "sharepassword"}
 	tmpls, err := NewTemplates("views", templateNames, makeTemplateFuncMap())
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse templates: %v", err)
 	}
 	server.Templates = tmpls
 
+	server.wg.Add(4)
+	go server.trashJanitor()
+	go server.tusJanitor()
+	go server.expirySweeper()
+	go server.storageCollector()
+
 	return server, nil
 }
 
+// NewOfflineServer creates a Server for maintenance commands such as Fsck, with
+// only the user-file DB and the given file storage Backend. Unlike NewServer,
+// no background tasks are started, and the Server may not serve requests. If
+// the DB is in use by another process, such as a running server, an error is
+// returned after a few seconds rather than waiting for it.
+func NewOfflineServer(store storage.Backend) (*Server, error) {
+	userFileDB, err := storm.Open(userFileDBPath,
+		storm.BoltOptions(0600, &bolt.Options{Timeout: offlineDBTimeout}))
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("user-file DB %s is in use; stop the server first",
+			userFileDBPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed storm.Open: %v", err)
+	}
+	return &Server{
+		Storage:       store,
+		UserFileStore: userFileDB,
+		newHasher:     func() hash.Hash64 { return xxhash.New64() },
+		quit:          make(chan struct{}),
+	}, nil
+}
+
 // Shutdown cleanly shutsdown the Server
 func (s *Server) Shutdown() error {
+	close(s.quit)
+	s.wg.Wait()
 	return s.UserFileStore.Close()
 }
 
-// storeUserFileMapping stores the input user-fileid mapping in the on-disk DB.
-func (s *Server) storeUserFileMapping(user string, fileID uint64) error {
+// storeUserFileMapping stores the input user-fileid mapping in the on-disk DB,
+// with the user's file name, and the Unix time when the file expires, or zero
+// for no expiry.
+func (s *Server) storeUserFileMapping(user string, fileID uint64, name string, expires int64) error {
 	u := &UserFileStoreItem{
-		User:   user,
-		FileID: int64(fileID),
+		User:    user,
+		FileID:  int64(fileID),
+		Name:    name,
+		Expires: expires,
 	}
-	numExisting, err := s.UserFileStore.Select(q.Eq("User", u.User), q.Eq("FileID", u.FileID)).Count(u)
-	if err != nil {
+	var existing UserFileStoreItem
+	err := s.UserFileStore.Select(q.Eq("User", u.User), q.Eq("FileID", u.FileID)).First(&existing)
+	if err != nil && err != storm.ErrNotFound {
 		log.Warnf("Failed to query for existing records: %v", err)
 	}
-	if numExisting > 0 {
+	if err == nil {
 		log.Debugf("Existing record found: %s, %x", u.User, u.FileID)
-		return nil
+		// Uploading a file again restores it from the trash, and replaces
+		// its name and expiry.
+		if existing.DeletedAt == 0 && existing.Name == name && existing.Expires == expires {
+			return nil
+		}
+		u.RowID = existing.RowID
 	}
 	return s.UserFileStore.Save(u)
 }
 
+// fileAccessStatus determines if the user may access the file with the given
+// UID, either as an owner or via a FileGrant. http.StatusOK is returned if
+// access is permitted, and http.StatusGone if the access has expired.
+// Otherwise, the status is from deniedStatus.
+func (s *Server) fileAccessStatus(user string, uid uint64) (int, error) {
+	if user != "" {
+		owned, err := s.userOwnsFile(user, uid)
+		if err != nil {
+			return 0, err
+		}
+		if owned {
+			return http.StatusOK, nil
+		}
+		grant, err := s.userFileGrant(user, uid)
+		if err != nil {
+			return 0, err
+		}
+		if grant != nil {
+			return http.StatusOK, nil
+		}
+		expired, err := s.userFileExpired(user, uid)
+		if err != nil {
+			return 0, err
+		}
+		if expired {
+			return http.StatusGone, nil
+		}
+	}
+	return s.deniedStatus(uid)
+}
+
+// deniedStatus returns the http status code for a refused request for the file
+// with the given UID: http.StatusNotFound if the file does not exist or
+// existence is hidden by HideFileExistence, or http.StatusForbidden if it
+// exists. Files that are only in the trash or expired do not exist for this
+// purpose.
+func (s *Server) deniedStatus(uid uint64) (int, error) {
+	if s.HideFileExistence {
+		return http.StatusNotFound, nil
+	}
+	numMappings, err := s.UserFileStore.Select(q.Eq("FileID", int64(uid)),
+		activeMapping()).Count(&UserFileStoreItem{})
+	if err != nil {
+		return 0, err
+	}
+	if numMappings == 0 {
+		return http.StatusNotFound, nil
+	}
+	return http.StatusForbidden, nil
+}
+
+// refuseFileAccess writes the error response for a refused request for the
+// file with the given UID. See deniedStatus.
+func (s *Server) refuseFileAccess(w http.ResponseWriter, uid uint64) {
+	status, err := s.deniedStatus(uid)
+	if err != nil {
+		log.Errorf("Failed to check existence of file %016x: %v", uid, err)
+		status = http.StatusInternalServerError
+	}
+	switch status {
+	case http.StatusNotFound:
+		http.Error(w, "file not found", status)
+	case http.StatusForbidden:
+		http.Error(w, fmt.Sprintf("forbidden for file %016x", uid), status)
+	default:
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+// parseUID decodes a file UID, which must be a 16 character lowercase hex
+// string.
+func parseUID(UID string) (uint64, error) {
+	uid, err := strconv.ParseUint(UID, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	if fmt.Sprintf("%016x", uid) != UID {
+		return 0, fmt.Errorf("UID %s is not in canonical form", UID)
+	}
+	return uid, nil
+}
+
 // retrieveFileIDsByUser retrieves a slice of file IDs for the specified user
-// from the on-disk DB.
+// from the on-disk DB, excluding files in the user's trash and expired files.
 func (s *Server) retrieveFileIDsByUser(user string) ([]int64, error) {
 	var mappings []UserFileStoreItem
-	err := s.UserFileStore.Find("User", user, &mappings)
+	err := s.UserFileStore.Select(q.Eq("User", user), activeMapping()).Find(&mappings)
 	if err != nil {
 		return nil, err
 	}
@@ -130,6 +346,37 @@ func (s *Server) retrieveFileIDsByUser(user string) ([]int64, error) {
 	return FileIDs, err
 }
 
+// ownerFileName retrieves the file name given by the owner of the file with the
+// given UID. An empty string is returned if the name is not known, as for files
+// uploaded before names were recorded for each user.
+func (s *Server) ownerFileName(owner string, uid uint64) (string, error) {
+	var mapping UserFileStoreItem
+	err := s.UserFileStore.Select(q.Eq("User", owner), q.Eq("FileID", int64(uid)),
+		activeMapping()).First(&mapping)
+	if err == storm.ErrNotFound {
+		return "", nil
+	}
+	return mapping.Name, err
+}
+
+// userFileName retrieves the name of the file with the given UID as uploaded by
+// the user, or for a file shared with the user, as uploaded by the owner. An
+// empty string is returned if the name is not known.
+func (s *Server) userFileName(user string, uid uint64) (string, error) {
+	owned, err := s.userOwnsFile(user, uid)
+	if err != nil {
+		return "", err
+	}
+	if owned {
+		return s.ownerFileName(user, uid)
+	}
+	grant, err := s.userFileGrant(user, uid)
+	if err != nil || grant == nil {
+		return "", err
+	}
+	return s.ownerFileName(grant.Owner, uid)
+}
+
 func (s *Server) root(w http.ResponseWriter, r *http.Request) {
 	d, err := s.Templates.ExecTemplateToString("root", nil)
 	if err != nil {
@@ -141,7 +388,10 @@ func (s *Server) root(w http.ResponseWriter, r *http.Request) {
 }
 
 // File is the handler for file downloads, requiring the "{fileid}" URL path
-// parameter (e.g. /file/{fileid}).
+// parameter (e.g. /file/{fileid}). GET and HEAD requests are supported,
+// including range and conditional requests. The "disposition=inline" URL query
+// requests that the file be displayed in the browser, if it is of a type that
+// is safe to do so.
 func (s *Server) File(w http.ResponseWriter, r *http.Request) {
 	// Extract the file's unique id from the path
 	fileID := chi.URLParam(r, "fileid")
@@ -154,43 +404,264 @@ func (s *Server) File(w http.ResponseWriter, r *http.Request) {
 
 	// Check authorization
 	if !middleware.RequestCtxAuthzed(r) {
-		http.Error(w, "unauthorized for file "+fileID, http.StatusUnauthorized)
+		http.Error(w, "forbidden for file "+fileID, http.StatusForbidden)
 		return
 	}
 
-	// Locate file in storage by it's UID
-	fullFile, statusCode, err := s.UIDToFilePath(fileID, false)
+	// Send the file with the name the user knows it by.
+	uid, _ := parseUID(fileID)
+	name, err := s.userFileName(middleware.RequestCtxUser(r), uid)
 	if err != nil {
-		log.Errorln(err)
-		http.Error(w, err.Error(), statusCode)
+		log.Errorf("Failed to retrieve name of file %s: %v", fileID, err)
+	}
+
+	s.sendStoredFile(w, r, uid, name)
+}
+
+// DeleteFile is the handler for DELETE requests to remove a file, requiring the
+// "{fileid}" URL path parameter (e.g. /file/{fileid}). The file's owner, or a
+// user granted delete permission by the owner, may delete it. The file is moved
+// to the owner's trash, from which it is permanently deleted by deleteUserFile
+// after TrashRetention. While in the trash, the grants and share links for the
+// file may not be used.
+func (s *Server) DeleteFile(w http.ResponseWriter, r *http.Request) {
+	user := middleware.RequestCtxUser(r)
+	fileID := chi.URLParam(r, "fileid")
+	uid, err := parseUID(fileID)
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	owner := user
+	owned, err := s.userOwnsFile(user, uid)
+	if err != nil {
+		log.Errorf("Failed to check ownership of file %s: %v", fileID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !owned {
+		grant, err := s.userFileGrant(user, uid)
+		if err != nil {
+			log.Errorf("Failed to retrieve grant for file %s: %v", fileID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if grant == nil {
+			s.refuseFileAccess(w, uid)
+			return
+		}
+		if !grant.CanDelete {
+			http.Error(w, "insufficient permission to delete file "+fileID,
+				http.StatusForbidden)
+			return
+		}
+		owner = grant.Owner
+	}
+
+	if s.TrashRetention > 0 {
+		err = s.trashUserFile(owner, uid)
+	} else {
+		err = s.deleteUserFile(owner, uid)
+	}
+	if err != nil {
+		log.Errorf("Failed to delete file %s: %v", fileID, err)
+		http.Error(w, err.Error(), storageErrorStatus(err))
+		return
+	}
+
+	log.Infof("User %s deleted %s's file %s.", user, owner, fileID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteUserFile removes the user-file mapping for the owner and file UID,
+// along with the grants and share links for the owner's file. If no other
+// user-file mappings reference the UID, including those of files in the trash,
+// the file is deleted from storage along with its FileRecord. Any matchers
+// further restrict the owner's mapping, and storm.ErrNotFound is returned if no
+// mapping matches. The DB changes are made in a single transaction, and the
+// file is deleted from storage only after it is committed, so that a failure
+// leaves at worst an orphaned file for fsck to find rather than DB rows for a
+// file that is gone.
+func (s *Server) deleteUserFile(owner string, uid uint64, matchers ...q.Matcher) error {
+	s.fileMtx.Lock()
+	defer s.fileMtx.Unlock()
+
+	tx, err := s.UserFileStore.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	fileID := int64(uid)
+	query := tx.Select(append([]q.Matcher{q.Eq("User", owner), q.Eq("FileID", fileID)},
+		matchers...)...)
+	numMappings, err := query.Count(&UserFileStoreItem{})
+	if err != nil {
+		return err
+	}
+	if numMappings == 0 {
+		return storm.ErrNotFound
+	}
+	if err = query.Delete(&UserFileStoreItem{}); err != nil {
+		return err
+	}
+	err = tx.Select(q.Eq("Owner", owner), q.Eq("FileID", fileID)).Delete(&FileGrant{})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	err = tx.Select(q.Eq("Owner", owner), q.Eq("FileID", fileID)).Delete(&ShareLink{})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	remaining, err := tx.Select(q.Eq("FileID", fileID)).Count(&UserFileStoreItem{})
+	if err != nil {
+		return err
+	}
+	if remaining == 0 {
+		err = tx.DeleteStruct(&FileRecord{FileID: fileID})
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		err = tx.DeleteStruct(&ScrubRecord{FileID: fileID})
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if remaining == 0 {
+		UID := fmt.Sprintf("%016x", uid)
+		if err = s.Storage.Delete(UID); err != nil && err != storage.ErrNotFound {
+			log.Errorf("Failed to delete file %s from storage: %v", UID, err)
+			return nil
+		}
+		log.Infof("Deleted file %s from storage.", UID)
+	}
+	return nil
+}
+
+// sendStoredFile sends the file with the given UID from storage, with the given
+// file name, or the name from storage if name is empty. The
+// "disposition=inline" URL query requests that the file be displayed in the
+// browser, if it is of a type that is safe to do so. A file that the integrity
+// scrubber found corrupt is refused rather than sent.
+func (s *Server) sendStoredFile(w http.ResponseWriter, r *http.Request, uid uint64, name string) {
+	UID := fmt.Sprintf("%016x", uid)
+	corrupt, err := s.fileCorrupt(uid)
+	if err != nil {
+		log.Errorf("Failed to check integrity record of file %s: %v", UID, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	if corrupt {
+		log.Warnf("Refusing to send corrupt file %s.", UID)
+		http.Error(w, errFileCorrupt.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Send the file
-	if err = response.SendFile(w, fullFile); err != nil {
+	// Locate file in storage by it's UID. A compressed file is sent as
+	// stored if the client accepts its encoding, and is otherwise
+	// decompressed as it is sent. Ranges of a decompressed file are not
+	// served, since each range out of order restarts decompression.
+	file, info, err := s.Storage.Get(UID)
+	var decompressed bool
+	if err == nil && info.ContentEncoding != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if info.ContentEncoding != encodingGzip || !acceptsGzip(r) {
+			file.Close()
+			file, info, err = s.openStoredFile(uid)
+			decompressed = true
+		}
+	}
+	if err != nil {
 		log.Errorln(err)
-		http.Error(w, err.Error(), statusCode)
+		http.Error(w, err.Error(), storageErrorStatus(err))
 		return
 	}
+	defer file.Close()
+	if name == "" {
+		name = info.Name
+	}
+
+	// The SHA-256 digest is sent if it is known, unless the file is sent
+	// compressed.
+	var digest []byte
+	var rec FileRecord
+	err = s.UserFileStore.One("FileID", int64(uid), &rec)
+	if err == nil && rec.SHA256 != "" && info.ContentEncoding == "" {
+		digest, _ = hex.DecodeString(rec.SHA256)
+	}
+
+	// Send the file, or the requested ranges of it. The UID is derived from
+	// the file's contents, so it is used as a strong ETag, distinguished for
+	// the compressed representation.
+	etag := UID
+	if info.ContentEncoding != "" {
+		etag += "-" + info.ContentEncoding
+	}
+	response.SendFile(w, r, file, &response.FileInfo{
+		Name:            name,
+		ContentType:     info.ContentType,
+		Inline:          r.URL.Query().Get("disposition") == "inline",
+		ModTime:         info.ModTime,
+		ETag:            etag,
+		SHA256:          digest,
+		ContentEncoding: info.ContentEncoding,
+		IgnoreRanges:    decompressed,
+	})
 }
 
-// FileList generates a response containing a JSON array of file UIDs that the
-// user is permitted to access.
+// FileList generates a response describing the files that the user is
+// permitted to access, including files shared with the user. The URL query may
+// specify sorting, filtering, and pagination options (see
+// parseFileListOptions).
 func (s *Server) FileList(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseFileListOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Lookup files associated with this user
 	user := middleware.RequestCtxUser(r)
 	userFileIDs, err := s.retrieveFileIDsByUser(user)
 	if err != nil {
 		log.Infof("failed to retrieve file UIDs for user %s (no files uploaded?): %v", user, err)
-		response.WriteJSON(w, []string{}, "")
-		return
+	}
+	sharedFileIDs, err := s.retrieveSharedFileIDsByUser(user)
+	if err != nil && err != storm.ErrNotFound {
+		log.Errorf("failed to retrieve shared file UIDs for user %s: %v", user, err)
 	}
 
-	hexFileIDs := make([]string, 0, len(userFileIDs))
-	for _, fileID := range userFileIDs {
-		hexFileIDs = append(hexFileIDs, fmt.Sprintf("%016x", fileID))
+	files := make([]response.File, 0, len(userFileIDs)+len(sharedFileIDs))
+	seen := make(map[int64]bool, cap(files))
+	for i, fileID := range append(userFileIDs, sharedFileIDs...) {
+		if seen[fileID] {
+			continue
+		}
+		seen[fileID] = true
+		rec, err := s.fileRecord(uint64(fileID))
+		if err != nil {
+			log.Errorf("failed to retrieve record for file %016x: %v", fileID, err)
+			continue
+		}
+		// List the file with the name the user knows it by.
+		name, err := s.userFileName(user, uint64(fileID))
+		if err != nil {
+			log.Errorf("failed to retrieve name of file %016x: %v", fileID, err)
+		}
+		if name != "" {
+			rec.Name = name
+		}
+		files = append(files, fileRecordResponse(rec, user, i >= len(userFileIDs)))
 	}
-	response.WriteJSON(w, hexFileIDs, "    ")
+	response.WriteJSON(w, opts.apply(files), "    ")
 }
 
 // Token returns the user/session's current JWT.
@@ -204,7 +675,13 @@ func (s *Server) Token(w http.ResponseWriter, r *http.Request) {
 }
 
 // UploadFile is the upload handler for POST requests with the file data stored
-// in the body with Content-Type multipart/form-data.
+// in the body with Content-Type multipart/form-data. Every file part in the
+// request is stored, and the response lists the result for each file. The
+// optional "expires_in" or "expires_at" form values set when the files expire
+// (see parseExpiry). The client may provide digests that each file must match
+// (see parseUploadDigests), and a file that does not match is rejected. Since
+// the request is streamed, form values apply only to the file parts that follow
+// them.
 func (s *Server) UploadFile(w http.ResponseWriter, r *http.Request) {
 	session := middleware.RequestCtxJWTSession(r)
 	userJWT := middleware.RequestCtxToken(r)
@@ -228,93 +705,93 @@ func (s *Server) UploadFile(w http.ResponseWriter, r *http.Request) {
 		// Ensure it is a multipart/... media type
 		if !strings.HasPrefix(mediaType, "multipart/") {
 			http.Error(w, "invalid Content-Type "+mediaType, http.StatusBadRequest)
-		}
-
-		// Process the multipart.File upload
-		mpFile, fileHeader, err := s.formFile(uploadPostParam, r)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		defer mpFile.Close()
-
-		// Compute UID of file. Use a non-cryptographic hash function for speed.
-		hasher := xxhash.New64()
-		numBytes, err := io.Copy(hasher, mpFile)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		// UID is a 16 character hex string (8 bytes of data)
-		uid := hasher.Sum64()
-		UID := fmt.Sprintf("%016x", uid)
-		log.Infof("Hashed %d bytes. UID: %s", numBytes, UID)
 
-		_, err = mpFile.Seek(0, io.SeekStart)
+		// Limit the size of the request body, and stream the multipart
+		// parts rather than buffering the entire form with
+		// ParseMultipartForm.
+		r.Body = http.MaxBytesReader(w, r.Body, s.MaxFileSize)
+		mpReader, err := r.MultipartReader()
 		if err != nil {
-			log.Errorln(err)
-		}
-
-		// Copy file to storage folder, creating the folder first.
-		fullPath, _ := filepath.Abs(filepath.Join(s.FilesPath, UID))
-		if err = os.MkdirAll(fullPath, 0755); err != nil {
-			log.Errorln(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		// Combine path and file name, then sanitize it.
-		fullFile := filepath.Join(fullPath, filepath.Base(fileHeader.Filename))
-		fullFile = filepath.Clean(fullFile) // eliminates ".."
-		// Do not allow user to write outside of storage path.
-		if !strings.HasPrefix(fullFile, fullPath) {
-			http.Error(w, os.ErrPermission.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// Copy upload to storage folder
-		fid, err := os.OpenFile(fullFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-		if err != nil {
-			log.Errorln(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		// Store each file part in the request.
+		user := middleware.RequestCtxUser(r)
+		form := make(url.Values)
+		var uploads []response.Upload
+		var firstUpload *response.Upload
+		var firstErr error
+		for {
+			part, err := nextFilePart(mpReader, form)
+			if err == http.ErrMissingFile {
+				break
+			}
+			if err != nil {
+				// The request body is unreadable, so there are no
+				// more parts. Report it unless it was already
+				// reported for the previous part.
+				if firstErr == nil {
+					firstErr = err
+					uploads = append(uploads, response.Upload{Error: err.Error()})
+				}
+				break
+			}
+
+			var upload *response.Upload
+			var digests []expectedDigest
+			expires, err := parseExpiry(form.Get("expires_in"), form.Get("expires_at"))
+			if err == nil {
+				digests, err = parseUploadDigests(part.Header, form)
+			}
+			if err == nil {
+				upload, err = s.storeUpload(user, part.FileName(), part, expires, digests)
+			}
+			part.Close()
+			if err != nil {
+				log.Errorf("Failed to store upload %s: %v", part.FileName(), err)
+				if firstErr == nil {
+					firstErr = err
+				}
+				failed := response.Upload{
+					FileName: part.FileName(),
+					Error:    err.Error(),
+				}
+				if dmErr, ok := err.(*digestMismatchError); ok {
+					failed.Mismatches = dmErr.mismatches
+				}
+				uploads = append(uploads, failed)
+				continue
+			}
+			if firstUpload == nil {
+				firstUpload = upload
+			}
+			uploads = append(uploads, *upload)
 		}
-		defer fid.Close()
 
-		numBytesStored, err := io.Copy(fid, mpFile)
-		if err != nil {
-			log.Errorln(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if len(uploads) == 0 {
+			http.Error(w, http.ErrMissingFile.Error(), http.StatusBadRequest)
 			return
 		}
-		if numBytesStored != numBytes {
-			log.Errorf("File %s not stored completely. %d B hashed, %d B copied",
-				fullFile, numBytes, numBytesStored)
-		}
-
-		// Store the original file name in a text file "NAME".
-		err = ioutil.WriteFile(filepath.Join(fullPath, "NAME"),
-			[]byte(fileHeader.Filename), 0644)
-		if err != nil {
-			log.Errorln(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if firstUpload == nil {
+			// Describe each mismatched digest rather than just the first
+			// error.
+			if _, ok := firstErr.(*digestMismatchError); ok {
+				response.WriteJSONStatus(w, uploadErrorStatus(firstErr),
+					&response.UploadResponse{Files: uploads, Token: userJWT}, "    ")
+				return
+			}
+			http.Error(w, firstErr.Error(), uploadErrorStatus(firstErr))
 			return
 		}
 
-		// Register this file with the user
-		user := middleware.RequestCtxUser(r)
-		if err = s.storeUserFileMapping(user, uid); err != nil {
-			log.Errorf("Failed to store user-file mapping [%s,%d]: %v", user, uid, err)
-		}
-
 		// Write success response to user
 		resp := &response.UploadResponse{
-			Upload: response.Upload{
-				UID:      UID,
-				FileName: fileHeader.Filename,
-				Size:     numBytes,
-			},
-			Token: userJWT,
+			Upload: *firstUpload,
+			Files:  uploads,
+			Token:  userJWT,
 		}
 		response.WriteJSON(w, resp, "    ")
 
@@ -324,57 +801,190 @@ func (s *Server) UploadFile(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// UIDToFilePath looks up the file name for the file with unique identifier UID,
-// and returns the absolute path to the files, a http status code, and an error.
-func (s *Server) UIDToFilePath(UID string, mkdir bool) (string, int, error) {
-	// Get full path to file in storage location
-	fullPath, _ := filepath.Abs(filepath.Join(s.FilesPath, UID))
-	if mkdir {
-		if err := os.MkdirAll(fullPath, 0755); err != nil {
-			return "", http.StatusInternalServerError, err
-		}
-		// TODO if existed, return notfound error
+// storageErrorStatus maps a storage.Backend error to a http status code.
+func storageErrorStatus(err error) int {
+	switch err {
+	case storage.ErrNotFound:
+		return http.StatusNotFound
+	case storage.ErrInvalidUID, os.ErrPermission:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// storeUpload stores the file data read from src, with the given original file
+// name, and associates it with the user until the expires Unix time, or
+// indefinitely if expires is zero. The data is hashed to compute the UID as it
+// is written to storage, and the staged file is moved into place once the UID
+// is known. If the data does not match the expected digests, the staged file is
+// discarded and a *digestMismatchError is returned.
+func (s *Server) storeUpload(user, fileName string, src io.Reader, expires int64,
+	digests []expectedDigest) (*response.Upload, error) {
+	staged, err := storage.Stage(s.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compute UID of file. Use a non-cryptographic hash function for speed.
+	// The SHA-256 digest is computed in the same pass so that clients may
+	// verify the file. The content type is detected from the first bytes,
+	// and the file is stored compressed if the type is compressible.
+	hasher := s.newHasher()
+	sha256Hasher := sha256.New()
+	comp := newCompressor(staged, fileName, !s.DisableCompression)
+	verifier := newDigestVerifier(digests, sha256Hasher)
+	numBytes, err := io.Copy(io.MultiWriter(comp, hasher, sha256Hasher, verifier), src)
+	if err == nil {
+		err = comp.Close()
+	}
+	if err != nil {
+		staged.Abort()
+		return nil, err
 	}
+	verified, err := verifier.verify()
+	if err != nil {
+		staged.Abort()
+		return nil, err
+	}
+	digest := sha256Hasher.Sum(nil)
+	sha256Hex := hex.EncodeToString(digest)
+
+	// Move upload into place in storage, unless a different file is stored
+	// with the same UID.
+	meta := storage.Metadata{
+		Name:            filepath.Base(fileName),
+		ContentType:     comp.contentType,
+		ContentEncoding: comp.encoding,
+	}
+	s.fileMtx.Lock()
+	defer s.fileMtx.Unlock()
+	sum := hasher.Sum64()
+	uid, err := s.allocateUID(sum, digest)
+	if err != nil {
+		staged.Abort()
+		return nil, err
+	}
+	// UID is a 16 character hex string (8 bytes of data)
+	UID := fmt.Sprintf("%016x", uid)
+	log.Infof("Hashed %d bytes. UID: %s", numBytes, UID)
+	if err = staged.Commit(UID, meta); err != nil {
+		return nil, err
+	}
+	// A file that was found corrupt is replaced by the upload.
+	s.clearScrubFailure(uid)
 
-	// Get original name of file
-	fName, err := ioutil.ReadFile(filepath.Join(fullPath, "NAME"))
-	if err != nil || len(fName) == 0 {
-		log.Errorf("NAME file in %s unreadable: %v", fullPath, err)
-		return "", http.StatusInternalServerError, err
+	// Register this file with the user
+	if err = s.storeUserFileMapping(user, uid, meta.Name, expires); err != nil {
+		log.Errorf("Failed to store user-file mapping [%s,%d]: %v", user, uid, err)
+	}
+	err = s.storeFileRecord(&FileRecord{
+		FileID:      int64(uid),
+		Name:        meta.Name,
+		Size:        numBytes,
+		ContentType: meta.ContentType,
+		Uploaded:    time.Now(),
+		Uploader:    user,
+		Checksums:   map[string]string{"xxh64": fmt.Sprintf("%016x", sum), "sha256": sha256Hex},
+		SHA256:      sha256Hex,
+	})
+	if err != nil {
+		log.Errorf("Failed to store record for file %s: %v", UID, err)
 	}
 
-	fullFile := filepath.Join(fullPath, string(fName))
-	fullFile = filepath.Clean(fullFile)
-	if !strings.HasPrefix(fullFile, fullPath) {
-		return "", http.StatusBadRequest, os.ErrPermission
+	return &response.Upload{
+		UID:         UID,
+		FileName:    fileName,
+		Size:        numBytes,
+		ContentType: meta.ContentType,
+		SHA256:      sha256Hex,
+		Expires:     expires,
+
+		VerifiedDigests: verified,
+	}, nil
+}
+
+// contentSniffer is an io.Writer that keeps the first bytes written to it,
+// as many as are considered by http.DetectContentType.
+type contentSniffer struct {
+	data []byte
+}
+
+// sniffLen is the number of bytes considered by http.DetectContentType.
+const sniffLen = 512
+
+// Write keeps up to sniffLen bytes. It never fails.
+func (cs *contentSniffer) Write(p []byte) (int, error) {
+	if need := sniffLen - len(cs.data); need > 0 {
+		if need > len(p) {
+			need = len(p)
+		}
+		cs.data = append(cs.data, p[:need]...)
 	}
-	return fullFile, http.StatusOK, nil
+	return len(p), nil
 }
 
-var multipartByReader = &multipart.Form{
-	Value: make(map[string][]string),
-	File:  make(map[string][]*multipart.FileHeader),
+// detectContentType determines the MIME type of a file from the extension of
+// its name, or from the first bytes of its contents if the extension is not
+// recognized.
+func detectContentType(fileName string, head []byte) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(fileName)); contentType != "" {
+		return contentType
+	}
+	return http.DetectContentType(head)
 }
 
-// formFile gets the file for the given key (e.g. "fileupload") from the
-// request's parsed multipart form, calling ParseMultipartForm first if
-// necessary. On success, a non-nil multipart.File and multipart.FileHeader are
-// returned, but the error must be checked to ensure it was opened successfully.
-func (s *Server) formFile(key string, r *http.Request) (multipart.File, *multipart.FileHeader, error) {
-	if r.MultipartForm == multipartByReader {
-		return nil, nil, errors.New("http: multipart handled by MultipartReader")
+// errRequestTooLarge is the error message of the error returned when reading
+// beyond the limit of a reader from http.MaxBytesReader.
+const errRequestTooLarge = "http: request body too large"
+
+// uploadErrorStatus maps an error encountered while processing an upload to a
+// http status code.
+func uploadErrorStatus(err error) int {
+	if _, ok := err.(*digestMismatchError); ok {
+		return http.StatusBadRequest
 	}
-	if r.MultipartForm == nil {
-		err := r.ParseMultipartForm(s.MaxFileSize)
+	switch {
+	case err == http.ErrMissingFile, err == errInvalidExpiry, err == errInvalidDigest:
+		return http.StatusBadRequest
+	case err.Error() == errRequestTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case err == io.ErrUnexpectedEOF, strings.HasPrefix(err.Error(), "multipart:"):
+		return http.StatusBadRequest
+	}
+	return storageErrorStatus(err)
+}
+
+// maxFormValueLen is the longest form value accepted in an upload request.
+const maxFormValueLen = 1024
+
+// nextFilePart advances the multipart.Reader to the next file part. The values
+// of any other parts are set in form, replacing previous values with the same
+// name. If there are no more file parts, http.ErrMissingFile is returned.
+func nextFilePart(mr *multipart.Reader, form url.Values) (*multipart.Part, error) {
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, http.ErrMissingFile
+		}
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
-	}
-	if r.MultipartForm != nil && r.MultipartForm.File != nil {
-		if fhs := r.MultipartForm.File[key]; len(fhs) > 0 {
-			f, err := fhs[0].Open()
-			return f, fhs[0], err
+		if part.FileName() != "" {
+			return part, nil
+		}
+		if name := part.FormName(); name != "" {
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxFormValueLen+1))
+			if err != nil {
+				part.Close()
+				return nil, err
+			}
+			if len(value) > maxFormValueLen {
+				part.Close()
+				return nil, fmt.Errorf("multipart: form value %s too long", name)
+			}
+			form.Set(name, string(value))
 		}
+		part.Close()
 	}
-	return nil, nil, http.ErrMissingFile
 }
@@ -0,0 +1,107 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chappjc/webfiles/storage"
+)
+
+// newTestServer creates a Server with in-memory file storage, working in a
+// temporary folder containing the user-file DB, cookie store, and a copy of
+// the page templates. The returned function shuts down the Server and removes
+// the folder.
+func newTestServer(t *testing.T) (*Server, func()) {
+	templates, err := filepath.Abs(filepath.Join("..", "cmd", "webfiles", "views"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "webfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+
+	views := filepath.Join(dir, "views")
+	for _, folder := range []string{views, filepath.Join(dir, "cookies")} {
+		if err = os.Mkdir(folder, 0700); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(templates, "*.tmpl"))
+	if err != nil || len(files) == 0 {
+		cleanup()
+		t.Fatalf("no templates found in %s: %v", templates, err)
+	}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(views, filepath.Base(file)), b, 0600)
+		}
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+
+	if err = os.Chdir(dir); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	s, err := NewServer("test secret", "cookies", 1<<20, storage.NewMemory(), time.Hour)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.Shutdown()
+		cleanup()
+	}
+}
+
+// newTestOfflineServer creates a Server with NewOfflineServer and the given
+// storage Backend, as the fsck command does, working in a temporary folder
+// containing the user-file DB. No background tasks are started, so the Server's
+// fields may be set before it is used. The returned function shuts down the
+// Server and removes the folder.
+func newTestOfflineServer(t *testing.T, store storage.Backend) (*Server, func()) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "webfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+	if err = os.Chdir(dir); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	s, err := NewOfflineServer(store)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.Shutdown()
+		cleanup()
+	}
+}
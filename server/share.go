@@ -0,0 +1,577 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chappjc/webfiles/middleware"
+	"github.com/chappjc/webfiles/response"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/go-chi/chi"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultShareLinkLifetime = 24 * time.Hour
+	maxShareLinkLifetime     = 365 * 24 * time.Hour
+	// shareLinkHMACDomain separates share link signatures from other uses of
+	// the signing key.
+	shareLinkHMACDomain = "webfiles share link v1"
+	// shareUnlockHMACDomain separates the signatures of the cookies that
+	// record a correct password for a share link.
+	shareUnlockHMACDomain = "webfiles share unlock v1"
+	// shareUnlockLifetime is how long a correct password unlocks a link.
+	shareUnlockLifetime = time.Hour
+	// maxSharePasswordLen is the longest password bcrypt can hash.
+	maxSharePasswordLen = 72
+	// After shareLinkMaxAttempts incorrect passwords, a link is locked for
+	// shareLinkLockout.
+	shareLinkMaxAttempts = 5
+	shareLinkLockout     = 15 * time.Minute
+)
+
+var (
+	errShareLinkInvalid = errors.New("invalid share link")
+	errShareLinkExpired = errors.New("share link expired")
+	errShareLinkUsedUp  = errors.New("share link download limit reached")
+	errShareLinkLocked  = errors.New("too many incorrect passwords, try again later")
+	errSharePassword    = errors.New("incorrect password")
+)
+
+// ShareLink is the type in the storm user-file DB describing a public link to
+// a file, which may be used to download the file without a JWT until it
+// expires, reaches its download limit, or is revoked (deleted) by the owner.
+type ShareLink struct {
+	ID     string `storm:"id"`
+	FileID int64  `storm:"index"`
+	Owner  string `storm:"index"`
+	// Expires is a Unix timestamp.
+	Expires int64
+	// MaxDownloads is the download limit, or zero for no limit.
+	MaxDownloads int64
+	Downloads    int64
+	Created      time.Time
+
+	// PasswordHash is the bcrypt hash of the link's password, or nil if no
+	// password is required. LockedUntil is a Unix timestamp before which
+	// passwords are not checked, set after too many FailedAttempts.
+	PasswordHash   []byte
+	FailedAttempts int
+	LockedUntil    int64
+}
+
+// payload serializes the fields of the link that are signed in its token: the
+// ID, file ID, expiry, and download limit.
+func (l *ShareLink) payload() []byte {
+	id, _ := hex.DecodeString(l.ID)
+	b := make([]byte, len(id)+24)
+	copy(b, id)
+	binary.BigEndian.PutUint64(b[len(id):], uint64(l.FileID))
+	binary.BigEndian.PutUint64(b[len(id)+8:], uint64(l.Expires))
+	binary.BigEndian.PutUint64(b[len(id)+16:], uint64(l.MaxDownloads))
+	return b
+}
+
+// shareLinkMAC computes the HMAC-SHA256 of the payload with the server's
+// signing key.
+func (s *Server) shareLinkMAC(payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(s.SigningKey))
+	mac.Write([]byte(shareLinkHMACDomain))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// shareLinkToken creates the signed token for the link, which is the
+// base64url-encoded payload and HMAC, separated by a period.
+func (s *Server) shareLinkToken(l *ShareLink) string {
+	payload := l.payload()
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(s.shareLinkMAC(payload))
+}
+
+// verifyShareLinkToken checks the token's signature, and returns the link ID
+// and file ID from the payload.
+func (s *Server) verifyShareLinkToken(token string) (string, int64, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", 0, errShareLinkInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(payload) <= 24 {
+		return "", 0, errShareLinkInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, s.shareLinkMAC(payload)) {
+		return "", 0, errShareLinkInvalid
+	}
+	idLen := len(payload) - 24
+	id := hex.EncodeToString(payload[:idLen])
+	fileID := int64(binary.BigEndian.Uint64(payload[idLen:]))
+	return id, fileID, nil
+}
+
+// shareLinkResponse converts a ShareLink for a JSON response.
+func (s *Server) shareLinkResponse(r *http.Request, l *ShareLink) *response.ShareLink {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return &response.ShareLink{
+		ID:           l.ID,
+		UID:          fmt.Sprintf("%016x", uint64(l.FileID)),
+		URL:          fmt.Sprintf("%s://%s/s/%s", scheme, r.Host, s.shareLinkToken(l)),
+		Expires:      l.Expires,
+		MaxDownloads: l.MaxDownloads,
+		Downloads:    l.Downloads,
+		Created:      l.Created.Unix(),
+		Protected:    l.PasswordHash != nil,
+	}
+}
+
+// ownedFileUID extracts the file UID from the "{fileid}" URL path parameter,
+// and checks that CtxUser owns the file. If not, an error response is written
+// and ok is false.
+func (s *Server) ownedFileUID(w http.ResponseWriter, r *http.Request) (uid uint64, ok bool) {
+	user := middleware.RequestCtxUser(r)
+	fileID := chi.URLParam(r, "fileid")
+	uid, err := parseUID(fileID)
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return 0, false
+	}
+	owned, err := s.userOwnsFile(user, uid)
+	if err != nil {
+		log.Errorf("Failed to check ownership of file %s: %v", fileID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	if !owned {
+		s.refuseFileAccess(w, uid)
+		return 0, false
+	}
+	return uid, true
+}
+
+// CreateShareLink is the handler for POST requests to create a public link to
+// a file, requiring the "{fileid}" URL path parameter (e.g.
+// /file/{fileid}/links). Only the file's owner may create links. The optional
+// form values are "expires_in", a duration such as "72h" (default 24h),
+// "max_downloads", the number of times the file may be downloaded (default
+// unlimited), and "password", which must be entered to download the file.
+func (s *Server) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	uid, ok := s.ownedFileUID(w, r)
+	if !ok {
+		return
+	}
+
+	lifetime := defaultShareLinkLifetime
+	if v := r.FormValue("expires_in"); v != "" {
+		var err error
+		lifetime, err = time.ParseDuration(v)
+		if err != nil || lifetime <= 0 || lifetime > maxShareLinkLifetime {
+			http.Error(w, "invalid expires_in", http.StatusBadRequest)
+			return
+		}
+	}
+	var maxDownloads int64
+	if v := r.FormValue("max_downloads"); v != "" {
+		var err error
+		maxDownloads, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxDownloads < 0 {
+			http.Error(w, "invalid max_downloads", http.StatusBadRequest)
+			return
+		}
+	}
+	var passwordHash []byte
+	if password := r.FormValue("password"); password != "" {
+		if len(password) > maxSharePasswordLen {
+			http.Error(w, "password too long", http.StatusBadRequest)
+			return
+		}
+		var err error
+		passwordHash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Errorf("Failed to hash share link password: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		log.Errorf("Failed to generate share link ID: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	link := &ShareLink{
+		ID:           hex.EncodeToString(id),
+		FileID:       int64(uid),
+		Owner:        middleware.RequestCtxUser(r),
+		Expires:      now.Add(lifetime).Unix(),
+		MaxDownloads: maxDownloads,
+		Created:      now,
+		PasswordHash: passwordHash,
+	}
+	if err := s.UserFileStore.Save(link); err != nil {
+		log.Errorf("Failed to store share link: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("User %s created share link %s for file %016x.", link.Owner, link.ID, uid)
+	response.WriteJSON(w, s.shareLinkResponse(r, link), "    ")
+}
+
+// ShareLinks is the handler for listing the owner's active links to a file,
+// requiring the "{fileid}" URL path parameter (e.g. /file/{fileid}/links).
+func (s *Server) ShareLinks(w http.ResponseWriter, r *http.Request) {
+	uid, ok := s.ownedFileUID(w, r)
+	if !ok {
+		return
+	}
+
+	var links []ShareLink
+	err := s.UserFileStore.Select(q.Eq("FileID", int64(uid)),
+		q.Eq("Owner", middleware.RequestCtxUser(r)),
+		q.Gt("Expires", time.Now().Unix())).Find(&links)
+	if err != nil && err != storm.ErrNotFound {
+		log.Errorf("Failed to retrieve share links: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]*response.ShareLink, 0, len(links))
+	for i := range links {
+		if links[i].MaxDownloads > 0 && links[i].Downloads >= links[i].MaxDownloads {
+			continue
+		}
+		resp = append(resp, s.shareLinkResponse(r, &links[i]))
+	}
+	response.WriteJSON(w, resp, "    ")
+}
+
+// RevokeShareLink is the handler for DELETE requests to revoke a link to a
+// file, requiring the "{fileid}" and "{linkid}" URL path parameters (e.g.
+// /file/{fileid}/links/{linkid}).
+func (s *Server) RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	uid, ok := s.ownedFileUID(w, r)
+	if !ok {
+		return
+	}
+
+	var link ShareLink
+	err := s.UserFileStore.One("ID", chi.URLParam(r, "linkid"), &link)
+	if err == storm.ErrNotFound || (err == nil && (link.FileID != int64(uid) ||
+		link.Owner != middleware.RequestCtxUser(r))) {
+		http.Error(w, "share link not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = s.UserFileStore.DeleteStruct(&link)
+	}
+	if err != nil {
+		log.Errorf("Failed to revoke share link: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("User %s revoked share link %s.", link.Owner, link.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// useShareLink verifies the token and retrieves the link. If count is true,
+// the download is counted against the link's limit. An error is returned if
+// the link is invalid, revoked, expired, or has reached its download limit.
+func (s *Server) useShareLink(token string, count bool) (*ShareLink, error) {
+	tx, err := s.UserFileStore.Begin(count)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	link, err := s.loadShareLink(tx, token)
+	if err != nil || !count {
+		return link, err
+	}
+	link.Downloads++
+	if err = tx.UpdateField(link, "Downloads", link.Downloads); err != nil {
+		return nil, err
+	}
+	return link, tx.Commit()
+}
+
+// loadShareLink verifies the token and retrieves the link using the given
+// storm node. An error is returned if the link is invalid, revoked, expired,
+// or has reached its download limit, or if the file is in the owner's trash or
+// has expired.
+func (s *Server) loadShareLink(node storm.Node, token string) (*ShareLink, error) {
+	id, fileID, err := s.verifyShareLinkToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var link ShareLink
+	if err = node.One("ID", id, &link); err != nil {
+		if err == storm.ErrNotFound {
+			return nil, errShareLinkInvalid
+		}
+		return nil, err
+	}
+	// The token must match the current link exactly.
+	if link.FileID != fileID || token != s.shareLinkToken(&link) {
+		return nil, errShareLinkInvalid
+	}
+	if time.Now().Unix() >= link.Expires {
+		return nil, errShareLinkExpired
+	}
+	if link.MaxDownloads > 0 && link.Downloads >= link.MaxDownloads {
+		return nil, errShareLinkUsedUp
+	}
+	// Links may not be used while the file is in the owner's trash, or after
+	// the file expires.
+	owned, err := node.Select(q.Eq("User", link.Owner), q.Eq("FileID", link.FileID),
+		activeMapping()).Count(&UserFileStoreItem{})
+	if err != nil {
+		return nil, err
+	}
+	if owned == 0 {
+		expired, err := node.Select(q.Eq("User", link.Owner), q.Eq("FileID", link.FileID),
+			expiredMapping()).Count(&UserFileStoreItem{})
+		if err != nil {
+			return nil, err
+		}
+		if expired > 0 {
+			return nil, errShareLinkExpired
+		}
+		return nil, errShareLinkInvalid
+	}
+	return &link, nil
+}
+
+// checkSharePassword verifies the password for the share link. After
+// shareLinkMaxAttempts consecutive incorrect passwords, the link is locked for
+// shareLinkLockout, and errShareLinkLocked is returned without checking the
+// password until the lockout ends.
+func (s *Server) checkSharePassword(token, password string) (*ShareLink, error) {
+	link, err := s.useShareLink(token, false)
+	if err != nil || link.PasswordHash == nil {
+		return link, err
+	}
+	if time.Now().Unix() < link.LockedUntil {
+		return link, errShareLinkLocked
+	}
+
+	// Hash outside of the DB transaction, which blocks other writers.
+	correct := len(password) <= maxSharePasswordLen &&
+		bcrypt.CompareHashAndPassword(link.PasswordHash, []byte(password)) == nil
+
+	tx, err := s.UserFileStore.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Reload the link, since concurrent attempts may have updated it.
+	link, err = s.loadShareLink(tx, token)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if now.Unix() < link.LockedUntil {
+		return link, errShareLinkLocked
+	}
+	if correct {
+		if link.FailedAttempts == 0 {
+			return link, nil
+		}
+		link.FailedAttempts = 0
+	} else {
+		link.FailedAttempts++
+		if link.FailedAttempts >= shareLinkMaxAttempts {
+			log.Warnf("Share link %s locked after %d incorrect passwords.",
+				link.ID, link.FailedAttempts)
+			link.FailedAttempts = 0
+			link.LockedUntil = now.Add(shareLinkLockout).Unix()
+		}
+	}
+	if err = tx.Save(link); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	if !correct {
+		return link, errSharePassword
+	}
+	return link, nil
+}
+
+// shareUnlockMAC computes the HMAC-SHA256 of the link ID, cookie expiry, and
+// password hash with the server's signing key. Including the password hash
+// invalidates the cookies if the link's password changes.
+func (s *Server) shareUnlockMAC(l *ShareLink, expires int64) []byte {
+	var exp [8]byte
+	binary.BigEndian.PutUint64(exp[:], uint64(expires))
+	mac := hmac.New(sha256.New, []byte(s.SigningKey))
+	mac.Write([]byte(shareUnlockHMACDomain))
+	mac.Write([]byte(l.ID))
+	mac.Write(exp[:])
+	mac.Write(l.PasswordHash)
+	return mac.Sum(nil)
+}
+
+// shareUnlockCookieName is the name of the cookie recording that the password
+// for the link was entered.
+func shareUnlockCookieName(l *ShareLink) string {
+	return "webfiles_share_" + l.ID
+}
+
+// setShareUnlockCookie sets a cookie, scoped to the share link's path, that
+// allows the file to be downloaded without entering the password again until
+// the cookie or link expires.
+func (s *Server) setShareUnlockCookie(w http.ResponseWriter, r *http.Request, l *ShareLink) {
+	expires := time.Now().Add(shareUnlockLifetime).Unix()
+	if expires > l.Expires {
+		expires = l.Expires
+	}
+	b := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(b, uint64(expires))
+	b = append(b, s.shareUnlockMAC(l, expires)...)
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareUnlockCookieName(l),
+		Value:    base64.RawURLEncoding.EncodeToString(b),
+		Path:     r.URL.Path,
+		Expires:  time.Unix(expires, 0),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	})
+}
+
+// shareUnlocked checks the request for a valid, unexpired cookie set by
+// setShareUnlockCookie for the link.
+func (s *Server) shareUnlocked(r *http.Request, l *ShareLink) bool {
+	cookie, err := r.Cookie(shareUnlockCookieName(l))
+	if err != nil {
+		return false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(b) != 8+sha256.Size {
+		return false
+	}
+	expires := int64(binary.BigEndian.Uint64(b))
+	return time.Now().Unix() < expires && hmac.Equal(b[8:], s.shareUnlockMAC(l, expires))
+}
+
+// sharePasswordPrompt writes the password prompt page for a protected share
+// link with the given status code and error message.
+func (s *Server) sharePasswordPrompt(w http.ResponseWriter, status int, errMsg string) {
+	page, err := s.Templates.ExecTemplateToString("sharepassword", struct {
+		Error string
+	}{errMsg})
+	if err != nil {
+		log.Errorf("Execute template failed: %v", err)
+		http.Error(w, "execute template failed", http.StatusInternalServerError)
+		return
+	}
+	response.WriteHTMLStatus(w, status, page)
+}
+
+// shareLinkError writes the error response for a share link that may not be
+// used.
+func shareLinkError(w http.ResponseWriter, err error) {
+	switch err {
+	case errShareLinkInvalid:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errShareLinkExpired, errShareLinkUsedUp:
+		http.Error(w, err.Error(), http.StatusGone)
+	default:
+		log.Errorf("Failed to retrieve share link: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// countsAsDownload indicates if the request for a shared file should be
+// counted against the link's download limit. Every GET request is counted,
+// including range requests, since any set of ranges may be used to download
+// the whole file. HEAD requests are not counted.
+func countsAsDownload(r *http.Request) bool {
+	return r.Method == http.MethodGet
+}
+
+// SharedFile is the handler for downloads via a share link, requiring the
+// "{token}" URL path parameter (e.g. /s/{token}). No JWT is required. If the
+// link is password protected and the password has not been entered, a page
+// prompting for the password is served instead of the file.
+func (s *Server) SharedFile(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	link, err := s.useShareLink(token, false)
+	if err != nil {
+		shareLinkError(w, err)
+		return
+	}
+	if link.PasswordHash != nil && !s.shareUnlocked(r, link) {
+		s.sharePasswordPrompt(w, http.StatusOK, "")
+		return
+	}
+
+	if countsAsDownload(r) {
+		if link, err = s.useShareLink(token, true); err != nil {
+			shareLinkError(w, err)
+			return
+		}
+	}
+
+	name, err := s.ownerFileName(link.Owner, uint64(link.FileID))
+	if err != nil {
+		log.Errorf("Failed to retrieve name of file %016x: %v", link.FileID, err)
+	}
+	s.sendStoredFile(w, r, uint64(link.FileID), name)
+}
+
+// UnlockSharedFile is the handler for POST requests with the "password" form
+// value for a password protected share link, requiring the "{token}" URL path
+// parameter (e.g. /s/{token}). If the password is correct, a cookie allowing
+// the download is set, and the client is redirected to the share link.
+// Otherwise, the password prompt is served again with an error message.
+func (s *Server) UnlockSharedFile(w http.ResponseWriter, r *http.Request) {
+	link, err := s.checkSharePassword(chi.URLParam(r, "token"), r.FormValue("password"))
+	switch err {
+	case nil:
+	case errSharePassword:
+		s.sharePasswordPrompt(w, http.StatusForbidden, "Incorrect password.")
+		return
+	case errShareLinkLocked:
+		retry := link.LockedUntil - time.Now().Unix()
+		if retry < 1 {
+			retry = 1
+		}
+		w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+		s.sharePasswordPrompt(w, http.StatusTooManyRequests,
+			"Too many incorrect passwords. Please try again later.")
+		return
+	default:
+		shareLinkError(w, err)
+		return
+	}
+
+	if link.PasswordHash != nil {
+		s.setShareUnlockCookie(w, r, link)
+	}
+	http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"time"
+
+	"github.com/chappjc/webfiles/storage"
+)
+
+// storageGCInterval is how often unreferenced data is reclaimed from a storage
+// Backend that requires it.
+const storageGCInterval = time.Hour
+
+// collectStorageGarbage reclaims unreferenced data from the storage Backend, if
+// it is a storage.GarbageCollector, and logs the deduplication achieved.
+func (s *Server) collectStorageGarbage() {
+	gc, ok := s.Storage.(storage.GarbageCollector)
+	if !ok {
+		return
+	}
+	stats, err := gc.CollectGarbage()
+	if err != nil {
+		log.Errorf("Failed to collect storage garbage: %v", err)
+		return
+	}
+	log.Infof("Storage: %d files of %d bytes stored in %d chunks of %d bytes "+
+		"(dedupe ratio %.2f). Removed %d unused chunks of %d bytes.",
+		stats.Files, stats.LogicalSize, stats.Chunks, stats.StoredSize,
+		stats.DedupeRatio(), stats.Removed, stats.RemovedSize)
+}
+
+// storageCollector periodically reclaims unreferenced storage until Shutdown.
+func (s *Server) storageCollector() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(storageGCInterval)
+	defer ticker.Stop()
+	for {
+		s.collectStorageGarbage()
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+	}
+}
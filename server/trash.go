@@ -0,0 +1,135 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/chappjc/webfiles/middleware"
+	"github.com/chappjc/webfiles/response"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/go-chi/chi"
+)
+
+// trashJanitorInterval is how often the trash janitor looks for files to
+// permanently delete.
+const trashJanitorInterval = 10 * time.Minute
+
+// trashUserFile moves the owner's file to their trash by setting the DeletedAt
+// time of the user-file mapping.
+func (s *Server) trashUserFile(owner string, uid uint64) error {
+	var mapping UserFileStoreItem
+	err := s.UserFileStore.Select(q.Eq("User", owner), q.Eq("FileID", int64(uid)),
+		activeMapping()).First(&mapping)
+	if err != nil {
+		return err
+	}
+	return s.UserFileStore.UpdateField(&mapping, "DeletedAt", time.Now().Unix())
+}
+
+// Trash is the handler for listing the files in the user's trash.
+func (s *Server) Trash(w http.ResponseWriter, r *http.Request) {
+	user := middleware.RequestCtxUser(r)
+	var mappings []UserFileStoreItem
+	err := s.UserFileStore.Select(q.Eq("User", user), q.Gt("DeletedAt", int64(0))).
+		OrderBy("DeletedAt").Find(&mappings)
+	if err != nil && err != storm.ErrNotFound {
+		log.Errorf("Failed to retrieve trash for user %s: %v", user, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	retention := int64(s.TrashRetention / time.Second)
+	trash := make([]response.TrashedFile, 0, len(mappings))
+	for i := range mappings {
+		trash = append(trash, response.TrashedFile{
+			UID:     fmt.Sprintf("%016x", uint64(mappings[i].FileID)),
+			Deleted: mappings[i].DeletedAt,
+			Purge:   mappings[i].DeletedAt + retention,
+		})
+	}
+	response.WriteJSON(w, trash, "    ")
+}
+
+// RestoreFile is the handler for POST requests to restore a file from the
+// user's trash, requiring the "{fileid}" URL path parameter (e.g.
+// /trash/{fileid}/restore).
+func (s *Server) RestoreFile(w http.ResponseWriter, r *http.Request) {
+	user := middleware.RequestCtxUser(r)
+	fileID := chi.URLParam(r, "fileid")
+	uid, err := parseUID(fileID)
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	var mapping UserFileStoreItem
+	err = s.UserFileStore.Select(q.Eq("User", user), q.Eq("FileID", int64(uid)),
+		q.Gt("DeletedAt", int64(0))).First(&mapping)
+	if err == storm.ErrNotFound {
+		http.Error(w, "file not found in trash", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = s.UserFileStore.UpdateField(&mapping, "DeletedAt", int64(0))
+	}
+	if err != nil {
+		log.Errorf("Failed to restore file %s: %v", fileID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("User %s restored file %s from the trash.", user, fileID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// purgeTrash permanently deletes the files that have been in the trash for
+// longer than TrashRetention.
+func (s *Server) purgeTrash() {
+	cutoff := time.Now().Add(-s.TrashRetention).Unix()
+	var mappings []UserFileStoreItem
+	err := s.UserFileStore.Select(q.Gt("DeletedAt", int64(0)),
+		q.Lte("DeletedAt", cutoff)).Find(&mappings)
+	if err != nil {
+		if err != storm.ErrNotFound {
+			log.Errorf("Failed to retrieve expired trash: %v", err)
+		}
+		return
+	}
+
+	for i := range mappings {
+		m := &mappings[i]
+		// The file may have been restored since it was found.
+		err = s.deleteUserFile(m.User, uint64(m.FileID), q.Gt("DeletedAt", int64(0)),
+			q.Lte("DeletedAt", cutoff))
+		if err == storm.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			log.Errorf("Failed to purge file %016x from trash: %v", m.FileID, err)
+			continue
+		}
+		log.Infof("Purged file %016x from %s's trash.", m.FileID, m.User)
+	}
+}
+
+// trashJanitor periodically purges expired files from the trash until the
+// Server is shut down.
+func (s *Server) trashJanitor() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(trashJanitorInterval)
+	defer ticker.Stop()
+	for {
+		s.purgeTrash()
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,540 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chappjc/webfiles/middleware"
+
+	"github.com/asdine/storm"
+	"github.com/go-chi/chi"
+)
+
+// Resumable uploads are implemented with the tus protocol, version 1.0.0, with
+// the creation, termination, checksum, and expiration extensions. See
+// https://tus.io.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,checksum,expiration"
+	tusChecksums  = "md5,sha1,sha256"
+	// tusStatusChecksumMismatch is the tus checksum extension's status code
+	// for a PATCH request body that does not match the Upload-Checksum.
+	tusStatusChecksumMismatch = 460
+	tusContentType            = "application/offset+octet-stream"
+	// tusUIDHeader is set on the response to the PATCH request that
+	// completes an upload, and on subsequent HEAD requests, to provide the
+	// UID of the stored file.
+	tusUIDHeader = "Webfiles-UID"
+
+	// tusUploadLifetime is how long an upload is kept after it was created or
+	// last received data. Incomplete uploads are then abandoned, and the
+	// records of complete uploads are removed.
+	tusUploadLifetime = 24 * time.Hour
+	// tusJanitorInterval is how often the tus janitor looks for expired
+	// uploads.
+	tusJanitorInterval = 10 * time.Minute
+)
+
+// TusUpload is the type in the storm user-file DB describing a resumable upload
+// in progress. The partial file data is stored in Server.TusPath.
+type TusUpload struct {
+	ID       string `storm:"id"`
+	User     string `storm:"index"`
+	Length   int64
+	Offset   int64
+	FileName string
+	// Metadata is the Upload-Metadata header provided on creation.
+	Metadata string
+	Created  time.Time
+	// FileUID is set when the upload is complete and the file is stored.
+	FileUID string
+	// Expires is the Unix time when the stored file expires, or zero.
+	Expires int64
+	// Updated is when data was last received, or zero if none has been.
+	Updated time.Time
+}
+
+// uploadExpires returns the time after which the upload is removed.
+func (u *TusUpload) uploadExpires() time.Time {
+	if u.Updated.After(u.Created) {
+		return u.Updated.Add(tusUploadLifetime)
+	}
+	return u.Created.Add(tusUploadLifetime)
+}
+
+// tusLock marks the upload as busy so that concurrent PATCH or DELETE requests
+// for it are refused. The returned bool is false if it was already locked.
+func (s *Server) tusLock(id string) bool {
+	s.tusMtx.Lock()
+	defer s.tusMtx.Unlock()
+	if s.tusBusy[id] {
+		return false
+	}
+	s.tusBusy[id] = true
+	return true
+}
+
+func (s *Server) tusUnlock(id string) {
+	s.tusMtx.Lock()
+	delete(s.tusBusy, id)
+	s.tusMtx.Unlock()
+}
+
+// WithTusResumable sets the Tus-Resumable header on all responses, and rejects
+// requests other than OPTIONS that do not specify a supported protocol version.
+func WithTusResumable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TusOptions describes the server's tus protocol support.
+func (s *Server) TusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Checksum-Algorithm", tusChecksums)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.MaxFileSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusCreate is the handler for tus upload creation. The Upload-Length header is
+// required, and the file name may be provided in the Upload-Metadata header
+// with the "filename" or "name" key. The "expires_in" or "expires_at" keys set
+// when the stored file expires (see parseExpiry).
+func (s *Server) TusCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > s.MaxFileSize {
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata := r.Header.Get("Upload-Metadata")
+	meta, err := parseTusMetadata(metadata)
+	if err != nil {
+		http.Error(w, "invalid Upload-Metadata: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	fileName := meta["filename"]
+	if fileName == "" {
+		fileName = meta["name"]
+	}
+	if fileName = filepath.Base(fileName); fileName == "." || fileName == string(filepath.Separator) {
+		fileName = "upload"
+	}
+	expires, err := parseExpiry(meta["expires_in"], meta["expires_at"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := newTusID()
+	if err != nil {
+		log.Errorf("Failed to generate upload ID: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	upload := &TusUpload{
+		ID:       id,
+		User:     middleware.RequestCtxUser(r),
+		Length:   length,
+		FileName: fileName,
+		Metadata: metadata,
+		Created:  time.Now(),
+		Expires:  expires,
+	}
+
+	// Create the empty partial file, then record the upload.
+	if err = os.MkdirAll(s.TusPath, 0700); err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fid, err := os.OpenFile(s.tusFilePath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fid.Close()
+
+	if err = s.UserFileStore.Save(upload); err != nil {
+		log.Errorf("Failed to store tus upload %s: %v", id, err)
+		os.Remove(s.tusFilePath(id))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Created tus upload %s for %s (%d bytes).", id, fileName, length)
+
+	// An empty upload is complete on creation.
+	if length == 0 {
+		if err = s.tusFinish(upload); err != nil {
+			log.Errorf("Failed to store upload %s: %v", id, err)
+			http.Error(w, err.Error(), uploadErrorStatus(err))
+			return
+		}
+		w.Header().Set(tusUIDHeader, upload.FileUID)
+	}
+
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+id)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.uploadExpires().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// TusHead is the handler for tus upload offset requests.
+func (s *Server) TusHead(w http.ResponseWriter, r *http.Request) {
+	upload, status, err := s.userTusUpload(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	if upload.FileUID != "" {
+		w.Header().Set(tusUIDHeader, upload.FileUID)
+	}
+	w.Header().Set("Upload-Expires", upload.uploadExpires().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// TusPatch is the handler for tus requests that append data to an upload. When
+// the upload is complete, the file is stored in the same way as a file
+// uploaded with UploadFile.
+func (s *Server) TusPatch(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != tusContentType {
+		http.Error(w, "Content-Type must be "+tusContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	// Checksum extension
+	var checksum []byte
+	var hasher hash.Hash
+	if uploadChecksum := r.Header.Get("Upload-Checksum"); uploadChecksum != "" {
+		hasher, checksum, err = parseTusChecksum(uploadChecksum)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	id := chi.URLParam(r, "uploadid")
+	if !s.tusLock(id) {
+		http.Error(w, "upload is busy", http.StatusConflict)
+		return
+	}
+	defer s.tusUnlock(id)
+
+	upload, status, err := s.userTusUpload(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if offset != upload.Offset {
+		http.Error(w, "mismatched Upload-Offset", http.StatusConflict)
+		return
+	}
+	if upload.FileUID != "" {
+		http.Error(w, "upload already complete", http.StatusForbidden)
+		return
+	}
+
+	// Append the request body to the partial file.
+	partialFile := s.tusFilePath(upload.ID)
+	fid, err := os.OpenFile(partialFile, os.O_WRONLY, 0600)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer fid.Close()
+	if _, err = fid.Seek(upload.Offset, io.SeekStart); err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, upload.Length-upload.Offset)
+	if hasher != nil {
+		body = io.TeeReader(body, hasher)
+	}
+	numBytes, errCopy := io.Copy(fid, body)
+
+	// With a checksum, the data must be discarded unless it was received
+	// completely and verified. Otherwise the data received so far is kept so
+	// the client may resume from the new offset.
+	if hasher != nil && (errCopy != nil || !bytes.Equal(hasher.Sum(nil), checksum)) {
+		if err = fid.Truncate(upload.Offset); err != nil {
+			log.Errorf("Failed to truncate partial upload %s: %v", upload.ID, err)
+		}
+		if errCopy != nil {
+			http.Error(w, errCopy.Error(), uploadErrorStatus(errCopy))
+			return
+		}
+		http.Error(w, "checksum mismatch", tusStatusChecksumMismatch)
+		return
+	}
+
+	upload.Offset += numBytes
+	upload.Updated = time.Now()
+	if err = s.UserFileStore.Update(upload); err != nil {
+		log.Errorf("Failed to update tus upload %s: %v", upload.ID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Upload-Expires", upload.uploadExpires().UTC().Format(http.TimeFormat))
+	if errCopy != nil {
+		log.Warnf("tus upload %s interrupted at offset %d: %v", upload.ID, upload.Offset, errCopy)
+		http.Error(w, errCopy.Error(), uploadErrorStatus(errCopy))
+		return
+	}
+
+	if upload.Offset == upload.Length {
+		if err = fid.Close(); err != nil {
+			log.Errorln(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err = s.tusFinish(upload); err != nil {
+			log.Errorf("Failed to store upload %s: %v", upload.ID, err)
+			http.Error(w, err.Error(), uploadErrorStatus(err))
+			return
+		}
+		w.Header().Set(tusUIDHeader, upload.FileUID)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusDelete is the handler for tus upload termination.
+func (s *Server) TusDelete(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "uploadid")
+	if !s.tusLock(id) {
+		http.Error(w, "upload is busy", http.StatusConflict)
+		return
+	}
+	defer s.tusUnlock(id)
+
+	upload, status, err := s.userTusUpload(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if err = s.removeTusUpload(upload); err != nil {
+		log.Errorf("Failed to delete tus upload %s: %v", upload.ID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeTusUpload deletes the upload's record and its partial file, if any.
+func (s *Server) removeTusUpload(upload *TusUpload) error {
+	if err := s.UserFileStore.DeleteStruct(upload); err != nil {
+		return err
+	}
+	if err := os.Remove(s.tusFilePath(upload.ID)); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Failed to remove partial upload %s: %v", upload.ID, err)
+	}
+	return nil
+}
+
+// expireTusUploads removes the uploads that have expired. Uploads that are
+// receiving data are skipped.
+func (s *Server) expireTusUploads() {
+	var uploads []TusUpload
+	if err := s.UserFileStore.All(&uploads); err != nil {
+		log.Errorf("Failed to retrieve tus uploads: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for i := range uploads {
+		upload := &uploads[i]
+		if upload.uploadExpires().After(now) || !s.tusLock(upload.ID) {
+			continue
+		}
+		// Data may have been received since the upload was retrieved.
+		var current TusUpload
+		err := s.UserFileStore.One("ID", upload.ID, &current)
+		if err == nil && !current.uploadExpires().After(now) {
+			err = s.removeTusUpload(&current)
+			if err == nil {
+				log.Infof("Removed expired tus upload %s.", upload.ID)
+			}
+		}
+		if err != nil && err != storm.ErrNotFound {
+			log.Errorf("Failed to remove expired tus upload %s: %v", upload.ID, err)
+		}
+		s.tusUnlock(upload.ID)
+	}
+}
+
+// tusJanitor periodically removes expired uploads until the Server is shut
+// down.
+func (s *Server) tusJanitor() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(tusJanitorInterval)
+	defer ticker.Stop()
+	for {
+		s.expireTusUploads()
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// tusFinish stores the completed upload's file data, associates it with the
+// user, and removes the partial file.
+func (s *Server) tusFinish(upload *TusUpload) error {
+	partialFile := s.tusFilePath(upload.ID)
+	fid, err := os.Open(partialFile)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	stored, err := s.storeUpload(upload.User, upload.FileName, fid, upload.Expires, nil)
+	if err != nil {
+		return err
+	}
+
+	upload.FileUID = stored.UID
+	if err = s.UserFileStore.UpdateField(upload, "FileUID", upload.FileUID); err != nil {
+		log.Errorf("Failed to update tus upload %s: %v", upload.ID, err)
+	}
+	if err = os.Remove(partialFile); err != nil {
+		log.Errorf("Failed to remove partial upload %s: %v", upload.ID, err)
+	}
+	log.Infof("Completed tus upload %s. UID: %s", upload.ID, upload.FileUID)
+	return nil
+}
+
+// userTusUpload retrieves the upload identified by the "{uploadid}" URL path
+// parameter, verifying that it belongs to CtxUser and has not expired. On
+// error, a http status code is also returned.
+func (s *Server) userTusUpload(r *http.Request) (*TusUpload, int, error) {
+	id := chi.URLParam(r, "uploadid")
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return nil, http.StatusNotFound, fmt.Errorf("upload not found")
+	}
+
+	var upload TusUpload
+	err := s.UserFileStore.One("ID", id, &upload)
+	if err == storm.ErrNotFound || (err == nil && upload.User != middleware.RequestCtxUser(r)) {
+		return nil, http.StatusNotFound, fmt.Errorf("upload not found")
+	}
+	if err != nil {
+		log.Errorf("Failed to retrieve tus upload %s: %v", id, err)
+		return nil, http.StatusInternalServerError, err
+	}
+	if !upload.uploadExpires().After(time.Now()) {
+		return nil, http.StatusGone, fmt.Errorf("upload expired")
+	}
+	return &upload, http.StatusOK, nil
+}
+
+// tusFilePath returns the path to the partial file for the upload.
+func (s *Server) tusFilePath(id string) string {
+	return filepath.Join(s.TusPath, id)
+}
+
+// newTusID generates a random upload ID.
+func newTusID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header, which is a comma-separated
+// list of key and base64-encoded value pairs separated by a space.
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, " ", 2)
+		if len(kv) == 1 {
+			meta[kv[0]] = ""
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", kv[0], err)
+		}
+		meta[kv[0]] = string(value)
+	}
+	return meta, nil
+}
+
+// parseTusChecksum decodes an Upload-Checksum header, which specifies the hash
+// algorithm and the base64-encoded checksum separated by a space.
+func parseTusChecksum(header string) (hash.Hash, []byte, error) {
+	algSum := strings.SplitN(header, " ", 2)
+	if len(algSum) != 2 {
+		return nil, nil, fmt.Errorf("invalid Upload-Checksum")
+	}
+	checksum, err := base64.StdEncoding.DecodeString(algSum[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid Upload-Checksum: %v", err)
+	}
+
+	var hasher hash.Hash
+	switch algSum[0] {
+	case "md5":
+		hasher = md5.New()
+	case "sha1":
+		hasher = sha1.New()
+	case "sha256":
+		hasher = sha256.New()
+	default:
+		return nil, nil, fmt.Errorf("unsupported checksum algorithm %s", algSum[0])
+	}
+	return hasher, checksum, nil
+}
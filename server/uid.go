@@ -0,0 +1,86 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"github.com/chappjc/webfiles/storage"
+
+	"github.com/asdine/storm"
+)
+
+// maxUIDProbes is the number of UIDs tried for a file before giving up.
+const maxUIDProbes = 8
+
+// errUIDCollision is returned when no UID could be allocated for a file.
+var errUIDCollision = errors.New("unable to allocate a unique file UID")
+
+// allocateUID determines the UID for a file, given the UID computed by the
+// Server's hasher and the file's SHA-256 digest. The UID is normally the
+// hash, but if a different file is already stored with that UID, a
+// disambiguated UID derived from the SHA-256 digest is used instead. The
+// derived UIDs are tried in a fixed order, so identical files are always
+// allocated the same UID and remain deduplicated. The caller must hold fileMtx.
+func (s *Server) allocateUID(hashUID uint64, digest []byte) (uint64, error) {
+	uid := hashUID
+	for i := 1; ; i++ {
+		available, err := s.uidAvailable(uid, digest)
+		if err != nil {
+			return 0, err
+		}
+		if available {
+			return uid, nil
+		}
+		log.Warnf("UID collision: %016x is in use by a different file.", uid)
+		if i == maxUIDProbes {
+			return 0, errUIDCollision
+		}
+		uid = derivedUID(digest, i)
+	}
+}
+
+// derivedUID computes the i'th disambiguated UID for a file with the given
+// SHA-256 digest.
+func derivedUID(digest []byte, i int) uint64 {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(i))
+	h := sha256.New()
+	h.Write(digest)
+	h.Write(n[:])
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+// uidAvailable checks if the UID is unused, or is used by a file with the given
+// SHA-256 digest. Files stored before digests were recorded are hashed to
+// compare them.
+func (s *Server) uidAvailable(uid uint64, digest []byte) (bool, error) {
+	var rec FileRecord
+	err := s.UserFileStore.One("FileID", int64(uid), &rec)
+	if err != nil && err != storm.ErrNotFound {
+		return false, err
+	}
+	if err == nil && rec.SHA256 != "" {
+		return rec.SHA256 == hex.EncodeToString(digest), nil
+	}
+
+	file, _, err := s.openStoredFile(uid)
+	if err == storage.ErrNotFound {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return false, err
+	}
+	return bytes.Equal(h.Sum(nil), digest), nil
+}
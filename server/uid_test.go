@@ -0,0 +1,90 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package server
+
+import (
+	"bytes"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/chappjc/webfiles/middleware"
+)
+
+// constantHasher is a hash.Hash64 that hashes every file to the same value,
+// so that every upload collides.
+type constantHasher struct{}
+
+func (constantHasher) Write(p []byte) (int, error) { return len(p), nil }
+func (constantHasher) Sum(b []byte) []byte         { return append(b, 0, 0, 0, 0, 0, 0, 0, 42) }
+func (constantHasher) Reset()                      {}
+func (constantHasher) Size() int                   { return 8 }
+func (constantHasher) BlockSize() int              { return 1 }
+func (constantHasher) Sum64() uint64               { return 42 }
+
+func TestAllocateUIDCollision(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.newHasher = func() hash.Hash64 { return constantHasher{} }
+	router := NewRouter(s)
+
+	upload := func(user, name string, data []byte) string {
+		up, err := s.storeUpload(user, name, bytes.NewReader(data), 0, nil)
+		if err != nil {
+			t.Fatalf("upload of %s failed: %v", name, err)
+		}
+		return up.UID
+	}
+	download := func(user, UID string) []byte {
+		tok, _, err := middleware.NewSignedJWT(s.SigningKey, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/file/"+UID+"?jwt="+tok, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("download of %s by %s: status %d", UID, user, rec.Code)
+		}
+		return rec.Body.Bytes()
+	}
+
+	one, two := []byte("first file"), []byte("second file")
+	uidOne := upload("alice", "one.txt", one)
+	uidTwo := upload("bob", "two.txt", two)
+	if uidOne != "000000000000002a" {
+		t.Errorf("first file has UID %s, expected the hash", uidOne)
+	}
+	if uidTwo == uidOne {
+		t.Fatalf("different files were both stored as %s", uidOne)
+	}
+
+	if got := download("alice", uidOne); !bytes.Equal(got, one) {
+		t.Errorf("file %s is %q, expected %q", uidOne, got, one)
+	}
+	if got := download("bob", uidTwo); !bytes.Equal(got, two) {
+		t.Errorf("file %s is %q, expected %q", uidTwo, got, two)
+	}
+
+	// Identical content is deduplicated, whichever UID it was given.
+	if UID := upload("bob", "one-again.txt", one); UID != uidOne {
+		t.Errorf("re-upload of first file has UID %s, expected %s", UID, uidOne)
+	}
+	if UID := upload("alice", "two-again.txt", two); UID != uidTwo {
+		t.Errorf("re-upload of second file has UID %s, expected %s", UID, uidTwo)
+	}
+
+	// The checksum is the content hash, not the disambiguated UID.
+	uid, err := parseUID(uidTwo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := s.fileRecord(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := rec.Checksums["xxh64"]; sum != "000000000000002a" {
+		t.Errorf("second file has xxh64 checksum %s, expected the hash", sum)
+	}
+}
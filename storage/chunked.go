@@ -0,0 +1,620 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// Chunk boundaries are chosen by content-defined chunking (FastCDC), so
+	// that an insertion or deletion in a file changes only the chunks near
+	// it. Chunks are at least cdcMinSize and at most cdcMaxSize bytes, and
+	// cdcAvgSize bytes on average.
+	cdcMinSize = 16 << 10
+	cdcAvgSize = 64 << 10
+	cdcMaxSize = 256 << 10
+	// A boundary is found where the top bits of the rolling hash selected
+	// by the mask are zero. The stricter cdcMaskS is used before cdcAvgSize,
+	// and the looser cdcMaskL after, which normalizes the chunk sizes.
+	cdcMaskS = uint64(1<<18-1) << (64 - 18)
+	cdcMaskL = uint64(1<<14-1) << (64 - 14)
+
+	// chunkPrefix and manifestPrefix are prepended to the UIDs under which
+	// chunks and file manifests are stored in the underlying Backend.
+	chunkPrefix    = "chunk-"
+	manifestPrefix = "manifest-"
+	// manifestVersion is the version of the chunkManifest format. Version 1
+	// manifests, which identify chunks by their SHA-256 digests, are still
+	// read.
+	manifestVersion = 2
+	// chunkKeyDomain separates the key naming chunks from other uses of the
+	// secret it is derived from.
+	chunkKeyDomain = "webfiles chunk names v1"
+)
+
+// gearTable holds the random values of the gear rolling hash for each byte
+// value. It is derived deterministically so that chunk boundaries do not
+// change between runs.
+var gearTable = func() (t [256]uint64) {
+	for i := range t {
+		h := sha256.Sum256([]byte{'g', 'e', 'a', 'r', byte(i)})
+		t[i] = binary.BigEndian.Uint64(h[:8])
+	}
+	return
+}()
+
+// cdcCut finds the length of the first chunk of data. If data is shorter than
+// cdcMaxSize, it is assumed to be the end of the file.
+func cdcCut(data []byte) int {
+	n := len(data)
+	if n <= cdcMinSize {
+		return n
+	}
+	if n > cdcMaxSize {
+		n = cdcMaxSize
+	}
+	normal := cdcAvgSize
+	if normal > n {
+		normal = n
+	}
+	var fp uint64
+	i := cdcMinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&cdcMaskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&cdcMaskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// manifestChunk identifies a chunk of a file by the hex encoded HMAC-SHA256 of
+// its data, or in version 1 manifests, its SHA-256 digest.
+type manifestChunk struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// chunkManifest lists the chunks of a file in order.
+type chunkManifest struct {
+	Version int             `json:"version"`
+	Size    int64           `json:"size"`
+	Chunks  []manifestChunk `json:"chunks"`
+}
+
+// GCStats describes the data stored by a Backend, as determined by garbage
+// collection. LogicalSize is the total length of the stored files, and
+// StoredSize is the length of the data actually stored after deduplication.
+// Removed and RemovedSize describe the unreferenced data that was deleted.
+type GCStats struct {
+	Files       int   `json:"files"`
+	LogicalSize int64 `json:"logical_size"`
+	Chunks      int   `json:"chunks"`
+	StoredSize  int64 `json:"stored_size"`
+	Removed     int   `json:"removed"`
+	RemovedSize int64 `json:"removed_size"`
+}
+
+// DedupeRatio is the ratio of the total length of the stored files to the
+// length of the data stored for them.
+func (s *GCStats) DedupeRatio() float64 {
+	if s.StoredSize == 0 {
+		return 1
+	}
+	return float64(s.LogicalSize) / float64(s.StoredSize)
+}
+
+// GarbageCollector is implemented by Backends that keep data that is no longer
+// referenced once the files using it are deleted, which must be reclaimed
+// periodically.
+type GarbageCollector interface {
+	CollectGarbage() (*GCStats, error)
+}
+
+// Chunked is a Backend that splits files into content-defined chunks, and
+// stores each distinct chunk once in another Backend, so that files with
+// partly identical contents, such as successive builds, share storage. A
+// manifest listing the chunks of each file is stored with the file's Metadata.
+// Deleting a file deletes its manifest, and chunks that are no longer used are
+// deleted by CollectGarbage.
+//
+// Chunks are named by a keyed hash of their data, so that the underlying
+// Backend does not reveal the digests of the files' contents.
+//
+// Files stored without a manifest, such as those stored before chunking was
+// enabled, are read from the underlying Backend as stored.
+type Chunked struct {
+	backend Backend
+	key     []byte
+	// gcMtx is held by CollectGarbage.
+	gcMtx sync.Mutex
+
+	// mtx protects staged and released. staged counts the files being
+	// written that use each chunk. While garbage is collected, released is
+	// not nil, and records the chunks of the files committed or aborted
+	// since collection began, which the manifests it read may not include.
+	// CollectGarbage keeps both.
+	mtx      sync.Mutex
+	staged   map[string]int
+	released map[string]bool
+}
+
+// NewChunked creates a Chunked Backend storing chunks in b. The chunks are
+// named with a key derived from secret, and checked against their names when
+// read, so secret must not change once chunks are stored.
+func NewChunked(b Backend, secret []byte) *Chunked {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(chunkKeyDomain))
+	return &Chunked{
+		backend: b,
+		key:     mac.Sum(nil),
+		staged:  make(map[string]int),
+	}
+}
+
+// chunkHash computes the hex encoded hash identifying the chunk with the given
+// data in a manifest of the given version.
+func (c *Chunked) chunkHash(data []byte, version int) string {
+	if version == 1 {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hold records that a file being written uses the chunk with the given hash,
+// so that it is not collected.
+func (c *Chunked) hold(hash string) {
+	c.mtx.Lock()
+	c.staged[hash]++
+	c.mtx.Unlock()
+}
+
+// release records that a file using the chunks with the given hashes is no
+// longer being written.
+func (c *Chunked) release(hashes []string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, hash := range hashes {
+		if c.staged[hash]--; c.staged[hash] <= 0 {
+			delete(c.staged, hash)
+		}
+		if c.released != nil {
+			c.released[hash] = true
+		}
+	}
+}
+
+// readManifest reads the manifest of the file with the given UID. ErrNotFound
+// is returned if the file is not chunked.
+func (c *Chunked) readManifest(uid string) (*chunkManifest, *FileInfo, error) {
+	f, info, err := c.backend.Get(manifestPrefix + uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	m := new(chunkManifest)
+	if err = json.NewDecoder(f).Decode(m); err != nil {
+		return nil, nil, &CorruptError{
+			Detail: fmt.Sprintf("invalid manifest for %s: %v", uid, err),
+		}
+	}
+	if m.Version != 1 && m.Version != manifestVersion {
+		return nil, nil, fmt.Errorf("unknown manifest version %d for %s", m.Version, uid)
+	}
+	info.UID, info.Size = uid, m.Size
+	return m, info, nil
+}
+
+// storeChunk stores the chunk unless an identical chunk is already stored. The
+// caller must hold the chunk.
+func (c *Chunked) storeChunk(chunk manifestChunk, data []byte) error {
+	_, err := c.backend.Stat(chunkPrefix + chunk.Hash)
+	if err != ErrNotFound {
+		return err
+	}
+	_, err = c.backend.Put(chunkPrefix+chunk.Hash, Metadata{Name: "chunk"},
+		bytes.NewReader(data))
+	return err
+}
+
+// Put splits the data read from r into chunks and stores them. See the Backend
+// interface.
+func (c *Chunked) Put(uid string, meta Metadata, r io.Reader) (int64, error) {
+	staged, err := c.Stage()
+	if err != nil {
+		return 0, err
+	}
+	numBytes, err := io.Copy(staged, r)
+	if err != nil {
+		staged.Abort()
+		return numBytes, err
+	}
+	return numBytes, staged.Commit(uid, meta)
+}
+
+// chunkedStaged is a Staged file that stores chunks as data is written to it,
+// and stores the manifest on Commit. The chunks it uses are held until it is
+// committed or aborted.
+type chunkedStaged struct {
+	c        *Chunked
+	buf      []byte
+	manifest chunkManifest
+	held     []string
+	done     bool
+}
+
+// Stage begins writing a chunked file. See the Stager interface.
+func (c *Chunked) Stage() (Staged, error) {
+	return &chunkedStaged{
+		c:        c,
+		buf:      make([]byte, 0, 2*cdcMaxSize),
+		manifest: chunkManifest{Version: manifestVersion},
+	}, nil
+}
+
+// flush stores chunks from the buffer. Unless final, a chunk is only cut once
+// cdcMaxSize bytes are buffered, so that the boundary does not depend on how
+// the data was written.
+func (s *chunkedStaged) flush(final bool) error {
+	var n int
+	for len(s.buf)-n >= cdcMaxSize || (final && n < len(s.buf)) {
+		cut := cdcCut(s.buf[n:])
+		data := s.buf[n : n+cut]
+		chunk := manifestChunk{
+			Hash: s.c.chunkHash(data, manifestVersion),
+			Size: int64(len(data)),
+		}
+		s.c.hold(chunk.Hash)
+		s.held = append(s.held, chunk.Hash)
+		if err := s.c.storeChunk(chunk, data); err != nil {
+			return err
+		}
+		s.manifest.Chunks = append(s.manifest.Chunks, chunk)
+		s.manifest.Size += chunk.Size
+		n += cut
+	}
+	s.buf = s.buf[:copy(s.buf, s.buf[n:])]
+	return nil
+}
+
+// Write buffers the data, storing chunks as their boundaries are found.
+func (s *chunkedStaged) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		c := cdcMaxSize - len(s.buf)%cdcMaxSize
+		if c > len(p) {
+			c = len(p)
+		}
+		s.buf = append(s.buf, p[:c]...)
+		p = p[c:]
+		if err := s.flush(false); err != nil {
+			return n - len(p), err
+		}
+	}
+	return n, nil
+}
+
+// release allows garbage collection of the chunks once the file is committed
+// or aborted.
+func (s *chunkedStaged) release() {
+	if !s.done {
+		s.done = true
+		s.c.release(s.held)
+	}
+}
+
+// Commit stores the remaining chunks and the manifest, replacing any existing
+// file with the same UID. See the Staged interface.
+func (s *chunkedStaged) Commit(uid string, meta Metadata) error {
+	defer s.release()
+	if !validUID(uid) {
+		return ErrInvalidUID
+	}
+	if err := s.flush(true); err != nil {
+		return err
+	}
+	b, err := json.Marshal(&s.manifest)
+	if err != nil {
+		return err
+	}
+	if _, err = s.c.backend.Put(manifestPrefix+uid, meta, bytes.NewReader(b)); err != nil {
+		return err
+	}
+	// Remove any file with the same UID that was stored without chunking.
+	if err = s.c.backend.Delete(uid); err != nil && err != ErrNotFound {
+		log.Warnf("Failed to remove unchunked file %s: %v", uid, err)
+	}
+	return nil
+}
+
+// Abort discards the written data. Chunks that were already stored are
+// deleted by CollectGarbage if they are not used by another file. See the
+// Staged interface.
+func (s *chunkedStaged) Abort() error {
+	s.release()
+	return nil
+}
+
+// chunkedFile is a File that reads a chunked file one chunk at a time.
+type chunkedFile struct {
+	c       *Chunked
+	version int
+	chunks  []manifestChunk
+	// offsets[i] is the position of the start of chunks[i].
+	offsets []int64
+	size    int64
+	pos     int64
+	current int
+	data    []byte
+}
+
+// loadChunk reads the chunk with the given index, and checks its hash. A chunk
+// that is not stored is reported as corruption, since the file can never be
+// read.
+func (f *chunkedFile) loadChunk(i int) error {
+	chunk := f.chunks[i]
+	r, _, err := f.c.backend.Get(chunkPrefix + chunk.Hash)
+	if err != nil {
+		if err == ErrNotFound {
+			return &CorruptError{Detail: "missing chunk " + chunk.Hash}
+		}
+		return err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != chunk.Size || f.c.chunkHash(data, f.version) != chunk.Hash {
+		return &CorruptError{Detail: "corrupt chunk " + chunk.Hash}
+	}
+	f.data, f.current = data, i
+	return nil
+}
+
+// Read reads from the chunk containing the current position.
+func (f *chunkedFile) Read(p []byte) (int, error) {
+	if f.pos >= f.size {
+		return 0, io.EOF
+	}
+	i := sort.Search(len(f.offsets), func(i int) bool {
+		return f.offsets[i] > f.pos
+	}) - 1
+	if i != f.current {
+		if err := f.loadChunk(i); err != nil {
+			f.current = -1
+			return 0, err
+		}
+	}
+	n := copy(p, f.data[f.pos-f.offsets[i]:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+// Seek sets the position for the next Read. See io.Seeker.
+func (f *chunkedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return f.pos, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return f.pos, errors.New("negative position")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// Close satisfies io.Closer. Chunks are closed once they are read.
+func (f *chunkedFile) Close() error {
+	return nil
+}
+
+// Get opens the file for reading, reassembling it from its chunks as it is
+// read. See the Backend interface.
+func (c *Chunked) Get(uid string) (File, *FileInfo, error) {
+	if !validUID(uid) {
+		return nil, nil, ErrInvalidUID
+	}
+	m, info, err := c.readManifest(uid)
+	if err == ErrNotFound {
+		return c.backend.Get(uid)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	offsets := make([]int64, len(m.Chunks))
+	var offset int64
+	for i := range m.Chunks {
+		offsets[i] = offset
+		offset += m.Chunks[i].Size
+	}
+	return &chunkedFile{
+		c:       c,
+		version: m.Version,
+		chunks:  m.Chunks,
+		offsets: offsets,
+		size:    m.Size,
+		current: -1,
+	}, info, nil
+}
+
+// Stat describes the file from its manifest. See the Backend interface.
+func (c *Chunked) Stat(uid string) (*FileInfo, error) {
+	if !validUID(uid) {
+		return nil, ErrInvalidUID
+	}
+	_, info, err := c.readManifest(uid)
+	if err == ErrNotFound {
+		return c.backend.Stat(uid)
+	}
+	return info, err
+}
+
+// Delete removes the file's manifest, or the file if it is not chunked. See
+// the Backend interface.
+func (c *Chunked) Delete(uid string) error {
+	if !validUID(uid) {
+		return ErrInvalidUID
+	}
+	err := c.backend.Delete(manifestPrefix + uid)
+	if err == ErrNotFound {
+		return c.backend.Delete(uid)
+	}
+	return err
+}
+
+// List returns the UIDs of all stored files, chunked or not. See the Backend
+// interface.
+func (c *Chunked) List() ([]string, error) {
+	all, err := c.backend.List()
+	if err != nil {
+		return nil, err
+	}
+	uids := make([]string, 0, len(all))
+	for _, uid := range all {
+		switch {
+		case strings.HasPrefix(uid, chunkPrefix):
+		case strings.HasPrefix(uid, manifestPrefix):
+			uids = append(uids, strings.TrimPrefix(uid, manifestPrefix))
+		default:
+			uids = append(uids, uid)
+		}
+	}
+	sort.Strings(uids)
+	return uids, nil
+}
+
+// CollectGarbage deletes the chunks that are not used by any file, and reports
+// the deduplication achieved. Files may be written while garbage is collected,
+// and the chunks they use are kept. See the GarbageCollector interface.
+func (c *Chunked) CollectGarbage() (*GCStats, error) {
+	c.gcMtx.Lock()
+	defer c.gcMtx.Unlock()
+
+	c.mtx.Lock()
+	c.released = make(map[string]bool)
+	c.mtx.Unlock()
+	defer func() {
+		c.mtx.Lock()
+		c.released = nil
+		c.mtx.Unlock()
+	}()
+
+	all, err := c.backend.List()
+	if err != nil {
+		return nil, err
+	}
+	stats := new(GCStats)
+	used := make(map[string]bool)
+	for _, uid := range all {
+		if !strings.HasPrefix(uid, manifestPrefix) {
+			continue
+		}
+		m, _, err := c.readManifest(strings.TrimPrefix(uid, manifestPrefix))
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		stats.Files++
+		stats.LogicalSize += m.Size
+		for i := range m.Chunks {
+			used[m.Chunks[i].Hash] = true
+		}
+	}
+
+	for _, uid := range all {
+		if !strings.HasPrefix(uid, chunkPrefix) {
+			continue
+		}
+		info, err := c.backend.Stat(uid)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		removed, err := c.removeUnused(strings.TrimPrefix(uid, chunkPrefix), used)
+		if err != nil {
+			return nil, err
+		}
+		if removed {
+			stats.Removed++
+			stats.RemovedSize += info.Size
+		} else {
+			stats.Chunks++
+			stats.StoredSize += info.Size
+		}
+	}
+	return stats, nil
+}
+
+// removeUnused deletes the chunk with the given hash unless it is used by a
+// stored file or a file being written, reporting whether it was deleted. A file
+// being written that uses the chunk waits until it is deleted, and then stores
+// it again.
+func (c *Chunked) removeUnused(hash string, used map[string]bool) (bool, error) {
+	if used[hash] {
+		return false, nil
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.staged[hash] > 0 || c.released[hash] {
+		return false, nil
+	}
+	err := c.backend.Delete(chunkPrefix + hash)
+	if err != nil && err != ErrNotFound {
+		return false, err
+	}
+	return true, nil
+}
+
+// Damaged lists the unusable entries of the underlying Backend, if it is a
+// Checker. Damaged chunks are found when files are read. See the Checker
+// interface.
+func (c *Chunked) Damaged() ([]string, error) {
+	checker, ok := c.backend.(Checker)
+	if !ok {
+		return nil, nil
+	}
+	return checker.Damaged()
+}
+
+// RemoveDamaged deletes or quarantines an entry listed by Damaged. See the
+// Checker interface.
+func (c *Chunked) RemoveDamaged(name string, quarantine bool) error {
+	checker, ok := c.backend.(Checker)
+	if !ok {
+		return ErrNotFound
+	}
+	return checker.RemoveDamaged(name, quarantine)
+}
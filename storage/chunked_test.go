@@ -0,0 +1,133 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChunked(t *testing.T) {
+	testBackend(t, NewChunked(NewMemory(), []byte("secret")))
+}
+
+func TestChunkedNames(t *testing.T) {
+	mem := NewMemory()
+	c := NewChunked(mem, []byte("secret"))
+	data := []byte("chunk names do not reveal this data's digest")
+	if _, err := c.Put("0123456789abcdef", Metadata{}, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	list, err := mem.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range list {
+		if strings.Contains(name, hex.EncodeToString(sum[:])) {
+			t.Errorf("stored name %s contains the SHA-256 digest", name)
+		}
+	}
+	if got := readAll(t, c, "0123456789abcdef"); !bytes.Equal(got, data) {
+		t.Errorf("read %q, expected %q", got, data)
+	}
+}
+
+func TestChunkedMissingChunk(t *testing.T) {
+	mem := NewMemory()
+	c := NewChunked(mem, []byte("secret"))
+	data := make([]byte, 3*cdcMaxSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	if _, err := c.Put("0123456789abcdef", Metadata{}, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	list, err := mem.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range list {
+		if strings.HasPrefix(name, chunkPrefix) {
+			if err = mem.Delete(name); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+
+	// A file with a missing chunk is corrupt, rather than failing to read.
+	f, _, err := c.Get("0123456789abcdef")
+	if err == nil {
+		_, err = ioutil.ReadAll(f)
+		f.Close()
+	}
+	if _, ok := err.(*CorruptError); !ok {
+		t.Errorf("read of file with missing chunk returned %v, expected a CorruptError", err)
+	}
+}
+
+func TestChunkedCollectGarbage(t *testing.T) {
+	c := NewChunked(NewMemory(), []byte("secret"))
+	data := make([]byte, 3*cdcMaxSize)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// A file being written does not stop garbage collection, which keeps
+	// the chunks it has stored.
+	staged, err := c.Stage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = staged.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := c.CollectGarbage()
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("CollectGarbage failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CollectGarbage blocked by a file being written")
+	}
+	if err = staged.Commit("0123456789abcdef", Metadata{}); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if got := readAll(t, c, "0123456789abcdef"); !bytes.Equal(got, data) {
+		t.Fatal("file committed during garbage collection is damaged")
+	}
+
+	// Once the file is deleted, its chunks are collected.
+	if err = c.Delete("0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := c.CollectGarbage()
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if stats.Chunks != 0 || stats.Removed == 0 {
+		t.Errorf("CollectGarbage kept %d chunks and removed %d", stats.Chunks, stats.Removed)
+	}
+
+	// The chunks of an aborted file are collected too.
+	if staged, err = c.Stage(); err != nil {
+		t.Fatal(err)
+	}
+	staged.Write(data)
+	staged.Abort()
+	if stats, err = c.CollectGarbage(); err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if stats.Chunks != 0 || stats.Removed == 0 {
+		t.Errorf("CollectGarbage kept %d chunks of an aborted file", stats.Chunks)
+	}
+}
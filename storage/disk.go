@@ -0,0 +1,384 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dataFile is the name of the file in each UID folder that holds the stored
+// data, nameFile records the original name of the stored file, typeFile records
+// the MIME type, and encodingFile records the content encoding.
+const (
+	dataFile     = "data"
+	nameFile     = "NAME"
+	typeFile     = "TYPE"
+	encodingFile = "ENCODING"
+)
+
+const (
+	// stagePrefix begins the names of the temporary files of staged uploads.
+	stagePrefix = ".upload-"
+	// staleStageAge is the age after which a staged upload is considered
+	// abandoned.
+	staleStageAge = 24 * time.Hour
+	// quarantineDir is the folder in the storage root to which damaged files
+	// are moved.
+	quarantineDir = ".quarantine"
+)
+
+// Disk is a Backend that stores files on the local file system. Each file is
+// stored as <root>/<UID>/data, with the original file name recorded in
+// <root>/<UID>/NAME, the MIME type, if known, in <root>/<UID>/TYPE, and the
+// content encoding, if any, in <root>/<UID>/ENCODING. Files stored before the
+// data file was used are instead stored as <root>/<UID>/<name>, and are moved
+// when stored again.
+type Disk struct {
+	root string
+}
+
+// NewDisk creates a Disk Backend rooted at the given folder, creating the
+// folder if it does not exist.
+func NewDisk(root string) (*Disk, error) {
+	fullRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(fullRoot, 0755); err != nil {
+		return nil, err
+	}
+	return &Disk{root: fullRoot}, nil
+}
+
+// Root returns the absolute path of the storage folder.
+func (d *Disk) Root() string {
+	return d.root
+}
+
+// dir returns the absolute path of the folder for the given UID.
+func (d *Disk) dir(uid string) (string, error) {
+	if !validUID(uid) {
+		return "", ErrInvalidUID
+	}
+	return filepath.Join(d.root, uid), nil
+}
+
+// filePath combines the UID folder and file name, and sanitizes the result so
+// that it may not refer to a location outside of the UID folder.
+func filePath(dir, name string) (string, error) {
+	fullFile := filepath.Clean(filepath.Join(dir, filepath.Base(name)))
+	if !strings.HasPrefix(fullFile, dir+string(filepath.Separator)) {
+		return "", os.ErrPermission
+	}
+	return fullFile, nil
+}
+
+// readName reads the original file name recorded in the UID folder.
+func readName(dir string) (string, error) {
+	fName, err := ioutil.ReadFile(filepath.Join(dir, nameFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	if len(fName) == 0 {
+		log.Errorf("NAME file in %s is empty", dir)
+		return "", ErrNotFound
+	}
+	return string(fName), nil
+}
+
+// Put stores the data read from r in <root>/<UID>/data. See the Backend
+// interface.
+func (d *Disk) Put(uid string, meta Metadata, r io.Reader) (int64, error) {
+	staged, err := d.Stage()
+	if err != nil {
+		return 0, err
+	}
+	numBytes, err := io.Copy(staged, r)
+	if err != nil {
+		staged.Abort()
+		return numBytes, err
+	}
+	return numBytes, staged.Commit(uid, meta)
+}
+
+// diskStaged is a Staged file written to a temporary file in the storage root.
+type diskStaged struct {
+	*os.File
+	disk *Disk
+}
+
+// Stage creates a temporary file in the storage root that is renamed into the
+// UID folder on Commit. See the Stager interface.
+func (d *Disk) Stage() (Staged, error) {
+	tmp, err := ioutil.TempFile(d.root, stagePrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &diskStaged{File: tmp, disk: d}, nil
+}
+
+// Commit moves the temporary file to <root>/<UID>/data and records the name in
+// the NAME file. See the Staged interface.
+func (s *diskStaged) Commit(uid string, meta Metadata) error {
+	if err := s.Close(); err != nil {
+		os.Remove(s.Name())
+		return err
+	}
+	err := s.disk.commit(s.Name(), uid, meta)
+	if err != nil {
+		os.Remove(s.Name())
+	}
+	return err
+}
+
+// Abort closes and removes the temporary file. See the Staged interface.
+func (s *diskStaged) Abort() error {
+	s.Close()
+	return os.Remove(s.Name())
+}
+
+// commit renames tmpFile into the UID folder.
+func (d *Disk) commit(tmpFile, uid string, meta Metadata) error {
+	dir, err := d.dir(uid)
+	if err != nil {
+		return err
+	}
+	meta.Name = filepath.Base(meta.Name)
+
+	// Move file to storage folder, creating the folder first.
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Identical content may previously have been stored under another name.
+	oldName, err := readName(dir)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	if err = os.Chmod(tmpFile, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpFile, filepath.Join(dir, dataFile)); err != nil {
+		return err
+	}
+
+	// Store the original file name in a text file "NAME".
+	err = ioutil.WriteFile(filepath.Join(dir, nameFile), []byte(meta.Name), 0644)
+	if err != nil {
+		return err
+	}
+
+	// Store the MIME type in a text file "TYPE", and the content encoding
+	// in "ENCODING".
+	if err = writeOptional(filepath.Join(dir, typeFile), meta.ContentType); err != nil {
+		return err
+	}
+	if err = writeOptional(filepath.Join(dir, encodingFile), meta.ContentEncoding); err != nil {
+		return err
+	}
+
+	// A file stored under its original name is replaced by the data file,
+	// unless that name is one of the files written above.
+	if oldName != "" && !reservedName(oldName) {
+		if oldFile, err := filePath(dir, oldName); err == nil {
+			if err = os.Remove(oldFile); err != nil && !os.IsNotExist(err) {
+				log.Warnf("Failed to remove replaced file %s: %v", oldFile, err)
+			}
+		}
+	}
+	return nil
+}
+
+// reservedName checks if name is the name of the data file or one of the
+// metadata files in a UID folder, rather than a file stored under its original
+// name.
+func reservedName(name string) bool {
+	switch name {
+	case dataFile, nameFile, typeFile, encodingFile:
+		return true
+	}
+	return false
+}
+
+// writeOptional writes value to the file at path, or removes the file if value
+// is empty.
+func writeOptional(path, value string) error {
+	if value != "" {
+		return ioutil.WriteFile(path, []byte(value), 0644)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Get opens the stored file for reading. See the Backend interface.
+func (d *Disk) Get(uid string) (File, *FileInfo, error) {
+	fullFile, info, err := d.locate(uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(fullFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// Stat describes the stored file. See the Backend interface.
+func (d *Disk) Stat(uid string) (*FileInfo, error) {
+	_, info, err := d.locate(uid)
+	return info, err
+}
+
+// locate finds the full path to the file with the given UID, and describes it.
+// The data file is used if it exists, or else the file with the recorded name.
+func (d *Disk) locate(uid string) (string, *FileInfo, error) {
+	dir, err := d.dir(uid)
+	if err != nil {
+		return "", nil, err
+	}
+	name, err := readName(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	fullFile := filepath.Join(dir, dataFile)
+	stat, err := os.Stat(fullFile)
+	if os.IsNotExist(err) && !reservedName(name) {
+		if fullFile, err = filePath(dir, name); err != nil {
+			return "", nil, err
+		}
+		stat, err = os.Stat(fullFile)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil, ErrNotFound
+		}
+		return "", nil, err
+	}
+	// The TYPE file is absent for files of unknown type, and the ENCODING
+	// file for files stored as uploaded.
+	contentType, _ := ioutil.ReadFile(filepath.Join(dir, typeFile))
+	encoding, _ := ioutil.ReadFile(filepath.Join(dir, encodingFile))
+	return fullFile, &FileInfo{
+		Metadata: Metadata{
+			Name:            name,
+			ContentType:     string(contentType),
+			ContentEncoding: string(encoding),
+		},
+		UID:     uid,
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+	}, nil
+}
+
+// Delete removes the UID folder and its contents. See the Backend interface.
+func (d *Disk) Delete(uid string) error {
+	dir, err := d.dir(uid)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(dir); os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return os.RemoveAll(dir)
+}
+
+// List returns the UIDs of all folders in the storage root with a NAME file.
+// See the Backend interface.
+func (d *Disk) List() ([]string, error) {
+	entries, err := ioutil.ReadDir(d.root)
+	if err != nil {
+		return nil, err
+	}
+	uids := make([]string, 0, len(entries))
+	for _, fi := range entries {
+		if !fi.IsDir() || !validUID(fi.Name()) {
+			continue
+		}
+		if _, err = os.Stat(filepath.Join(d.root, fi.Name(), nameFile)); err != nil {
+			continue
+		}
+		uids = append(uids, fi.Name())
+	}
+	return uids, nil
+}
+
+// Damaged lists the UID folders that have no NAME file or no stored data, and the temporary files of abandoned uploads. See the Checker
+// interface.
+func (d *Disk) Damaged() ([]string, error) {
+	entries, err := ioutil.ReadDir(d.root)
+	if err != nil {
+		return nil, err
+	}
+	var damaged []string
+	for _, fi := range entries {
+		name := fi.Name()
+		if strings.HasPrefix(name, stagePrefix) {
+			if time.Since(fi.ModTime()) > staleStageAge {
+				damaged = append(damaged, name)
+			}
+			continue
+		}
+		if !fi.IsDir() || !validUID(name) {
+			continue
+		}
+		if _, _, err = d.locate(name); err == ErrNotFound {
+			damaged = append(damaged, name)
+		}
+	}
+	return damaged, nil
+}
+
+// RemoveDamaged deletes an entry listed by Damaged, or moves it to the
+// .quarantine folder. See the Checker interface.
+func (d *Disk) RemoveDamaged(name string, quarantine bool) error {
+	path, err := filePath(d.root, name)
+	if err != nil {
+		return err
+	}
+	if quarantine {
+		return d.quarantine(path)
+	}
+	return os.RemoveAll(path)
+}
+
+// Quarantine moves the UID folder to the .quarantine folder. See the
+// Quarantiner interface.
+func (d *Disk) Quarantine(uid string) error {
+	dir, err := d.dir(uid)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(dir); os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return d.quarantine(dir)
+}
+
+// quarantine moves the file or folder at path to the .quarantine folder. The
+// time is appended to the name, so that earlier quarantined entries with the
+// same name are kept.
+func (d *Disk) quarantine(path string) error {
+	qDir := filepath.Join(d.root, quarantineDir)
+	if err := os.MkdirAll(qDir, 0755); err != nil {
+		return err
+	}
+	dest := filepath.Join(qDir, fmt.Sprintf("%s.%d", filepath.Base(path),
+		time.Now().UnixNano()))
+	return os.Rename(path, dest)
+}
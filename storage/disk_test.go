@@ -0,0 +1,96 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestDisk(t *testing.T) (*Disk, func()) {
+	dir, err := ioutil.TempDir("", "webfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDisk(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return d, func() { os.RemoveAll(dir) }
+}
+
+func TestDisk(t *testing.T) {
+	d, cleanup := newTestDisk(t)
+	defer cleanup()
+	testBackend(t, d)
+}
+
+func TestDiskReservedNames(t *testing.T) {
+	d, cleanup := newTestDisk(t)
+	defer cleanup()
+
+	// Files named like the files in the UID folder are stored intact, with or
+	// without the metadata recorded in those files.
+	const uid = "0123456789abcdef"
+	for _, name := range []string{dataFile, nameFile, typeFile, encodingFile} {
+		for _, meta := range []Metadata{
+			{Name: name},
+			{Name: name, ContentType: "text/plain; charset=utf-8"},
+			{Name: name, ContentEncoding: "gzip"},
+		} {
+			data := "uploaded as " + name
+			if _, err := d.Put(uid, meta, strings.NewReader(data)); err != nil {
+				t.Fatalf("Put of %+v failed: %v", meta, err)
+			}
+			if got := readAll(t, d, uid); string(got) != data {
+				t.Errorf("read %q after Put of %+v, expected %q", got, meta, data)
+			}
+			info, err := d.Stat(uid)
+			if err != nil {
+				t.Fatalf("Stat failed: %v", err)
+			}
+			if info.Metadata != meta {
+				t.Errorf("Stat described %+v as %+v", meta, info.Metadata)
+			}
+		}
+	}
+}
+
+func TestDiskLegacyLayout(t *testing.T) {
+	d, cleanup := newTestDisk(t)
+	defer cleanup()
+
+	// Files were stored under their original names.
+	const uid = "0123456789abcdef"
+	dir := filepath.Join(d.Root(), uid)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for file, content := range map[string]string{
+		"old.txt": "stored under its name",
+		nameFile:  "old.txt",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readAll(t, d, uid); string(got) != "stored under its name" {
+		t.Errorf("read %q from file stored under its name", got)
+	}
+
+	// Storing the file again moves it to the data file.
+	if _, err := d.Put(uid, Metadata{Name: "new.txt"}, strings.NewReader("new")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if got := readAll(t, d, uid); string(got) != "new" {
+		t.Errorf("read %q after Put, expected %q", got, "new")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old.txt")); !os.IsNotExist(err) {
+		t.Errorf("file stored under its name not removed: %v", err)
+	}
+}
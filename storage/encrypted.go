@@ -0,0 +1,823 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// encryptedChunkSize is the length of the plaintext of each encrypted
+	// chunk of a file, except the last.
+	encryptedChunkSize = 64 << 10
+	// dataKeySuffix is appended to a file's UID to form the UID under which
+	// its wrapped data key was stored, before data keys were stored in the
+	// file's header.
+	dataKeySuffix = "-key"
+	// dataKeyVersion is the version of the dataKeyRecord format for data keys
+	// stored under the file's UID with dataKeySuffix.
+	dataKeyVersion = 1
+	// headerKeyVersion is the version of the dataKeyRecord format for data
+	// keys stored in the file's header. The file's UID is authenticated with
+	// its last chunk.
+	headerKeyVersion = 2
+	// encryptedMagic begins the header of an encrypted file. It is followed
+	// by the length of the JSON encoded dataKeyRecord as a 4 byte big endian
+	// integer, and the record.
+	encryptedMagic = "webfiles encrypted file\n"
+	// maxHeaderRecordLen limits the length of the dataKeyRecord in a header.
+	maxHeaderRecordLen = 4096
+	// masterKeyIDDomain separates master key IDs from other uses of the key.
+	masterKeyIDDomain = "webfiles master key id v1"
+	// gcmTagSize is the length of the authentication tag added to each
+	// chunk by AES-GCM.
+	gcmTagSize = 16
+)
+
+var (
+	// ErrUnknownMasterKey is returned when a file's data key is wrapped by a
+	// master key that is not configured.
+	ErrUnknownMasterKey = errors.New("data key wrapped by unknown master key")
+
+	// errCorruptCiphertext is returned when an encrypted file's length is not
+	// consistent with its chunk size.
+	errCorruptCiphertext = &CorruptError{Detail: "corrupt encrypted file"}
+)
+
+// MasterKey is a 256-bit key-encryption key that wraps the data keys of an
+// Encrypted Backend.
+type MasterKey [32]byte
+
+// ID identifies the master key without revealing it.
+func (k *MasterKey) ID() string {
+	h := sha256.New()
+	h.Write([]byte(masterKeyIDDomain))
+	h.Write(k[:])
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// ParseMasterKeys parses hex encoded master keys, one per line. Blank lines and
+// lines starting with # are ignored.
+func ParseMasterKeys(text string) ([]MasterKey, error) {
+	var keys []MasterKey
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		b, err := hex.DecodeString(line)
+		if err != nil || len(b) != len(MasterKey{}) {
+			return nil, fmt.Errorf("master key must be %d hex encoded bytes",
+				len(MasterKey{}))
+		}
+		var key MasterKey
+		copy(key[:], b)
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// dataKeyRecord is stored, JSON encoded, in the header of each encrypted file.
+// Key is the file's data key encrypted with the master key identified by
+// MasterKey, prefixed by the nonce.
+type dataKeyRecord struct {
+	Version   int    `json:"version"`
+	MasterKey string `json:"master_key"`
+	Key       []byte `json:"key"`
+	ChunkSize int64  `json:"chunk_size"`
+}
+
+// Encrypted is a Backend that encrypts the files stored in another Backend.
+// Each file is encrypted with its own random data key using AES-256-GCM in
+// chunks of encryptedChunkSize bytes, so that any part of a file may be read
+// without decrypting the rest. The data key is wrapped by the master key, and
+// stored in a header before the ciphertext, so that a file and its key are
+// always replaced together. The header is written before the file's UID is
+// known, so the UID is instead authenticated with the last chunk, which is
+// checked when the file is opened, so that a file copied to another UID can not
+// be read. Only the file data is encrypted, not the Metadata.
+//
+// Files encrypted before data keys were stored in the header have their key
+// stored in the underlying Backend under the file's UID with dataKeySuffix.
+// Files with neither, such as those stored before encryption was enabled, are
+// read unencrypted.
+type Encrypted struct {
+	backend Backend
+	// keys[0] wraps new data keys. Other keys may only unwrap them.
+	keys []MasterKey
+}
+
+// NewEncrypted creates an Encrypted Backend storing files in b. New data keys
+// are wrapped with the first master key, while the others are previous master
+// keys that are still accepted for existing files until they are re-wrapped
+// with Rewrap.
+func NewEncrypted(b Backend, keys []MasterKey) (*Encrypted, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no master key")
+	}
+	return &Encrypted{
+		backend: b,
+		keys:    keys,
+	}, nil
+}
+
+// masterKey finds the configured master key with the given ID.
+func (e *Encrypted) masterKey(id string) (*MasterKey, error) {
+	for i := range e.keys {
+		if e.keys[i].ID() == id {
+			return &e.keys[i], nil
+		}
+	}
+	return nil, ErrUnknownMasterKey
+}
+
+// newGCM creates an AES-256-GCM cipher with the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapKey encrypts the data key using the current master key. For a key stored
+// separately from its file, the file's UID is authenticated, so that the
+// wrapped key is only valid for that file. uid is empty for a key stored in the
+// file's header, since the file's last chunk authenticates its UID.
+func (e *Encrypted) wrapKey(uid string, dataKey []byte) (*dataKeyRecord, error) {
+	aead, err := newGCM(e.keys[0][:])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(dataKey)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	version := dataKeyVersion
+	if uid == "" {
+		version = headerKeyVersion
+	}
+	return &dataKeyRecord{
+		Version:   version,
+		MasterKey: e.keys[0].ID(),
+		Key:       aead.Seal(nonce, nonce, dataKey, []byte(uid)),
+		ChunkSize: encryptedChunkSize,
+	}, nil
+}
+
+// unwrapKey decrypts the data key for the file with the given UID.
+func (e *Encrypted) unwrapKey(uid string, rec *dataKeyRecord) ([]byte, error) {
+	switch rec.Version {
+	case dataKeyVersion:
+	case headerKeyVersion:
+		uid = ""
+	default:
+		return nil, fmt.Errorf("unknown data key version %d", rec.Version)
+	}
+	key, err := e.masterKey(rec.MasterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key[:])
+	if err != nil {
+		return nil, err
+	}
+	if len(rec.Key) < aead.NonceSize() {
+		return nil, &CorruptError{Detail: "invalid wrapped data key"}
+	}
+	nonce, wrapped := rec.Key[:aead.NonceSize()], rec.Key[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, wrapped, []byte(uid))
+	if err != nil {
+		return nil, &CorruptError{
+			Detail: fmt.Sprintf("failed to unwrap data key: %v", err),
+		}
+	}
+	return dataKey, nil
+}
+
+// readKeyRecord reads the data key record stored separately from the file with
+// the given UID. ErrNotFound is returned if there is no such record.
+func (e *Encrypted) readKeyRecord(uid string) (*dataKeyRecord, error) {
+	f, _, err := e.backend.Get(uid + dataKeySuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rec := new(dataKeyRecord)
+	if err = json.NewDecoder(f).Decode(rec); err != nil {
+		return nil, &CorruptError{
+			Detail: fmt.Sprintf("invalid data key record for %s: %v", uid, err),
+		}
+	}
+	if rec.ChunkSize <= 0 {
+		return nil, &CorruptError{
+			Detail: fmt.Sprintf("invalid chunk size %d for %s", rec.ChunkSize, uid),
+		}
+	}
+	return rec, nil
+}
+
+// writeKeyRecord stores the data key record for the file with the given UID
+// separately from the file.
+func (e *Encrypted) writeKeyRecord(uid string, rec *dataKeyRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = e.backend.Put(uid+dataKeySuffix, Metadata{
+		Name:        "key.json",
+		ContentType: "application/json",
+	}, bytes.NewReader(b))
+	return err
+}
+
+// encodeHeader serializes the header of an encrypted file with the data key
+// record.
+func encodeHeader(rec *dataKeyRecord) ([]byte, error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(encryptedMagic)+4, len(encryptedMagic)+4+len(b))
+	copy(header, encryptedMagic)
+	binary.BigEndian.PutUint32(header[len(encryptedMagic):], uint32(len(b)))
+	return append(header, b...), nil
+}
+
+// readHeader reads the header of an encrypted file from the start of f,
+// returning the data key record and the length of the header. A nil
+// *dataKeyRecord is returned if f has no header, and f must then be rewound.
+func readHeader(f io.Reader) (*dataKeyRecord, int64, error) {
+	prefix := make([]byte, len(encryptedMagic)+4)
+	_, err := io.ReadFull(f, prefix)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if string(prefix[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, 0, nil
+	}
+	n := binary.BigEndian.Uint32(prefix[len(encryptedMagic):])
+	if n > maxHeaderRecordLen {
+		return nil, 0, &CorruptError{
+			Detail: fmt.Sprintf("data key record length %d too long", n),
+		}
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(f, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, 0, &CorruptError{Detail: "truncated data key record"}
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read data key record: %v", err)
+	}
+	rec := new(dataKeyRecord)
+	if err = json.Unmarshal(b, rec); err != nil {
+		return nil, 0, &CorruptError{
+			Detail: fmt.Sprintf("invalid data key record: %v", err),
+		}
+	}
+	if rec.ChunkSize <= 0 {
+		return nil, 0, &CorruptError{
+			Detail: fmt.Sprintf("invalid chunk size %d", rec.ChunkSize),
+		}
+	}
+	return rec, int64(len(prefix) + len(b)), nil
+}
+
+// chunkNonce is the nonce for the chunk with the given index. The last chunk
+// is distinguished so that truncation of the file is detected.
+func chunkNonce(nonce []byte, index int64, last bool) []byte {
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	for i := 8; i < len(nonce); i++ {
+		nonce[i] = 0
+	}
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// plaintextSize computes the length of an encrypted file from the length of
+// its ciphertext. A file has at least one chunk, which may be empty.
+func plaintextSize(size, chunkSize int64) (int64, error) {
+	encChunkSize := chunkSize + gcmTagSize
+	chunks, rem := size/encChunkSize, size%encChunkSize
+	if rem == 0 && chunks > 0 {
+		return chunks * chunkSize, nil
+	}
+	if rem < gcmTagSize {
+		return 0, errCorruptCiphertext
+	}
+	return chunks*chunkSize + rem - gcmTagSize, nil
+}
+
+// Put encrypts and stores the data read from r. See the Backend interface.
+func (e *Encrypted) Put(uid string, meta Metadata, r io.Reader) (int64, error) {
+	staged, err := e.Stage()
+	if err != nil {
+		return 0, err
+	}
+	numBytes, err := io.Copy(staged, r)
+	if err != nil {
+		staged.Abort()
+		return numBytes, err
+	}
+	return numBytes, staged.Commit(uid, meta)
+}
+
+// encryptedStaged is a Staged file that encrypts the data written to it in
+// chunks, and writes the ciphertext to a Staged file of the underlying Backend.
+type encryptedStaged struct {
+	Staged
+	e     *Encrypted
+	aead  cipher.AEAD
+	nonce []byte
+	index int64
+	buf   []byte
+	out   []byte
+}
+
+// Stage begins writing an encrypted file with a new random data key, starting
+// with the header holding the wrapped key. See the Stager interface.
+func (e *Encrypted) Stage() (Staged, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := e.wrapKey("", dataKey)
+	if err != nil {
+		return nil, err
+	}
+	header, err := encodeHeader(rec)
+	if err != nil {
+		return nil, err
+	}
+	staged, err := Stage(e.backend)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = staged.Write(header); err != nil {
+		staged.Abort()
+		return nil, err
+	}
+	return &encryptedStaged{
+		Staged: staged,
+		e:      e,
+		aead:   aead,
+		nonce:  make([]byte, aead.NonceSize()),
+		buf:    make([]byte, 0, encryptedChunkSize),
+		out:    make([]byte, 0, encryptedChunkSize+gcmTagSize),
+	}, nil
+}
+
+// seal encrypts and writes the buffered chunk, authenticating the additional
+// data ad.
+func (s *encryptedStaged) seal(last bool, ad []byte) error {
+	s.out = s.aead.Seal(s.out[:0], chunkNonce(s.nonce, s.index, last), s.buf, ad)
+	s.index++
+	s.buf = s.buf[:0]
+	_, err := s.Staged.Write(s.out)
+	return err
+}
+
+// Write buffers the data, encrypting each full chunk once it is known not to
+// be the last.
+func (s *encryptedStaged) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(s.buf) == encryptedChunkSize {
+			if err := s.seal(false, nil); err != nil {
+				return n - len(p), err
+			}
+		}
+		c := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+c]
+		p = p[c:]
+	}
+	return n, nil
+}
+
+// Commit encrypts the last chunk, authenticating the UID, and commits the file,
+// which holds its data key, so that a file replaced by Commit is never read with the wrong key. Any
+// data key stored separately for the file it replaced is then deleted. See the
+// Staged interface.
+func (s *encryptedStaged) Commit(uid string, meta Metadata) error {
+	if !validUID(uid) {
+		s.Staged.Abort()
+		return ErrInvalidUID
+	}
+	if err := s.seal(true, []byte(uid)); err != nil {
+		s.Staged.Abort()
+		return err
+	}
+	if err := s.Staged.Commit(uid, meta); err != nil {
+		return err
+	}
+	// The header takes precedence, so a key that is not deleted is unused.
+	s.e.backend.Delete(uid + dataKeySuffix)
+	return nil
+}
+
+// decryptedFile is a File that decrypts an encrypted file one chunk at a time
+// as it is read.
+type decryptedFile struct {
+	f          File
+	aead       cipher.AEAD
+	nonce      []byte
+	chunkSize  int64
+	encSize    int64
+	size       int64
+	pos        int64
+	chunkIndex int64
+	chunk      []byte
+	enc        []byte
+
+	// dataOffset is the length of the header before the ciphertext.
+	dataOffset int64
+	// lastAD is the additional data authenticated with the last chunk, which
+	// is the UID for files with their data key in the header.
+	lastAD []byte
+}
+
+// Read decrypts the chunk containing the current position as needed.
+func (d *decryptedFile) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	index := d.pos / d.chunkSize
+	if index != d.chunkIndex {
+		if err := d.loadChunk(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.chunk[d.pos-index*d.chunkSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+// loadChunk reads and decrypts the chunk with the given index.
+func (d *decryptedFile) loadChunk(index int64) error {
+	encChunkSize := d.chunkSize + gcmTagSize
+	offset := index * encChunkSize
+	if _, err := d.f.Seek(d.dataOffset+offset, io.SeekStart); err != nil {
+		return err
+	}
+	n := encChunkSize
+	if rem := d.encSize - offset; rem < n {
+		n = rem
+	}
+	d.enc = d.enc[:n]
+	if _, err := io.ReadFull(d.f, d.enc); err != nil {
+		return err
+	}
+	last := offset+n == d.encSize
+	var ad []byte
+	if last {
+		ad = d.lastAD
+	}
+	chunk, err := d.aead.Open(d.chunk[:0], chunkNonce(d.nonce, index, last), d.enc, ad)
+	if err != nil {
+		d.chunkIndex = -1
+		return &CorruptError{
+			Detail: fmt.Sprintf("failed to decrypt chunk %d: %v", index, err),
+		}
+	}
+	d.chunk, d.chunkIndex = chunk, index
+	return nil
+}
+
+// Seek sets the position for the next Read. See io.Seeker.
+func (d *decryptedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return d.pos, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return d.pos, errors.New("negative position")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+// Close closes the underlying file.
+func (d *decryptedFile) Close() error {
+	return d.f.Close()
+}
+
+// open opens the stored file, and reads its data key record and the length of
+// its header. A nil *dataKeyRecord is returned if the file is not encrypted.
+func (e *Encrypted) open(uid string) (File, *FileInfo, *dataKeyRecord, int64, error) {
+	f, info, err := e.backend.Get(uid)
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+	rec, headerLen, err := readHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, 0, err
+	}
+	if rec != nil {
+		return f, info, rec, headerLen, nil
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, nil, 0, err
+	}
+	rec, err = e.readKeyRecord(uid)
+	if err == ErrNotFound {
+		return f, info, nil, 0, nil
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, 0, err
+	}
+	return f, info, rec, 0, nil
+}
+
+// Get opens the file for reading, decrypting it as it is read. The last chunk of
+// a file with its data key in the header is decrypted first, so that a file
+// stored under another UID is refused. See the Backend interface.
+func (e *Encrypted) Get(uid string) (File, *FileInfo, error) {
+	if !validUID(uid) {
+		return nil, nil, ErrInvalidUID
+	}
+	f, info, rec, headerLen, err := e.open(uid)
+	if err != nil || rec == nil {
+		return f, info, err
+	}
+	dataKey, err := e.unwrapKey(uid, rec)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	encSize := info.Size - headerLen
+	if info.Size, err = plaintextSize(encSize, rec.ChunkSize); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	d := &decryptedFile{
+		f:          f,
+		aead:       aead,
+		nonce:      make([]byte, aead.NonceSize()),
+		chunkSize:  rec.ChunkSize,
+		encSize:    encSize,
+		size:       info.Size,
+		chunkIndex: -1,
+		chunk:      make([]byte, 0, rec.ChunkSize),
+		enc:        make([]byte, rec.ChunkSize+gcmTagSize),
+		dataOffset: headerLen,
+	}
+	if rec.Version == headerKeyVersion {
+		d.lastAD = []byte(uid)
+		if err = d.loadChunk((encSize - 1) / (rec.ChunkSize + gcmTagSize)); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+	}
+	return d, info, nil
+}
+
+// Stat describes the file, with the length of the decrypted file. See the
+// Backend interface.
+func (e *Encrypted) Stat(uid string) (*FileInfo, error) {
+	if !validUID(uid) {
+		return nil, ErrInvalidUID
+	}
+	f, info, rec, headerLen, err := e.open(uid)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	if rec == nil {
+		return info, nil
+	}
+	info.Size, err = plaintextSize(info.Size-headerLen, rec.ChunkSize)
+	return info, err
+}
+
+// Delete removes the file and its data key. See the Backend interface.
+func (e *Encrypted) Delete(uid string) error {
+	if !validUID(uid) {
+		return ErrInvalidUID
+	}
+	if err := e.backend.Delete(uid); err != nil {
+		return err
+	}
+	if err := e.backend.Delete(uid + dataKeySuffix); err != nil && err != ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// List returns the UIDs of all stored files, excluding data keys. See the
+// Backend interface.
+func (e *Encrypted) List() ([]string, error) {
+	all, err := e.backend.List()
+	if err != nil {
+		return nil, err
+	}
+	uids := all[:0]
+	for _, uid := range all {
+		if !strings.HasSuffix(uid, dataKeySuffix) {
+			uids = append(uids, uid)
+		}
+	}
+	return uids, nil
+}
+
+// Rewrap wraps the data keys of all stored files with the current master key,
+// so that previous master keys may be retired. The files are not re-encrypted,
+// but a file with its data key in its header is stored again with the new
+// header. The number of data keys that were re-wrapped is returned.
+func (e *Encrypted) Rewrap() (int, error) {
+	all, err := e.backend.List()
+	if err != nil {
+		return 0, err
+	}
+	var rewrapped int
+	for _, uid := range all {
+		var done bool
+		if strings.HasSuffix(uid, dataKeySuffix) {
+			done, err = e.rewrapKeyRecord(strings.TrimSuffix(uid, dataKeySuffix))
+		} else {
+			done, err = e.rewrapHeader(uid)
+		}
+		if err != nil {
+			return rewrapped, err
+		}
+		if done {
+			rewrapped++
+		}
+	}
+	return rewrapped, nil
+}
+
+// rewrapKey unwraps the data key in the record for the file with the given UID,
+// and wraps it with the current master key. A nil *dataKeyRecord is returned if
+// it is already wrapped with the current master key.
+func (e *Encrypted) rewrapKey(uid string, rec *dataKeyRecord) (*dataKeyRecord, error) {
+	if rec.MasterKey == e.keys[0].ID() {
+		return nil, nil
+	}
+	dataKey, err := e.unwrapKey(uid, rec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key for %s: %v", uid, err)
+	}
+	if rec.Version == headerKeyVersion {
+		uid = ""
+	}
+	newRec, err := e.wrapKey(uid, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	newRec.ChunkSize = rec.ChunkSize
+	return newRec, nil
+}
+
+// rewrapKeyRecord re-wraps the data key stored separately from the file with
+// the given UID, reporting whether it was re-wrapped.
+func (e *Encrypted) rewrapKeyRecord(uid string) (bool, error) {
+	rec, err := e.readKeyRecord(uid)
+	if err != nil {
+		return false, err
+	}
+	newRec, err := e.rewrapKey(uid, rec)
+	if err != nil || newRec == nil {
+		return false, err
+	}
+	return true, e.writeKeyRecord(uid, newRec)
+}
+
+// rewrapHeader re-wraps the data key in the header of the file with the given
+// UID, storing the file again with the new header and its ciphertext,
+// reporting whether it was re-wrapped.
+func (e *Encrypted) rewrapHeader(uid string) (bool, error) {
+	f, info, err := e.backend.Get(uid)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	rec, _, err := readHeader(f)
+	if err != nil || rec == nil {
+		return false, err
+	}
+	newRec, err := e.rewrapKey(uid, rec)
+	if err != nil || newRec == nil {
+		return false, err
+	}
+	header, err := encodeHeader(newRec)
+	if err != nil {
+		return false, err
+	}
+
+	staged, err := Stage(e.backend)
+	if err != nil {
+		return false, err
+	}
+	if _, err = io.Copy(staged, io.MultiReader(bytes.NewReader(header), f)); err != nil {
+		staged.Abort()
+		return false, err
+	}
+	return true, staged.Commit(uid, info.Metadata)
+}
+
+// Damaged lists the data keys of files that are not stored, and any unusable
+// entries of the underlying Backend if it is a Checker. See the Checker
+// interface.
+func (e *Encrypted) Damaged() ([]string, error) {
+	all, err := e.backend.List()
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]bool, len(all))
+	for _, uid := range all {
+		stored[uid] = true
+	}
+	var damaged []string
+	for _, uid := range all {
+		if strings.HasSuffix(uid, dataKeySuffix) &&
+			!stored[strings.TrimSuffix(uid, dataKeySuffix)] {
+			damaged = append(damaged, uid)
+		}
+	}
+	if checker, ok := e.backend.(Checker); ok {
+		more, err := checker.Damaged()
+		if err != nil {
+			return nil, err
+		}
+		damaged = append(damaged, more...)
+	}
+	return damaged, nil
+}
+
+// RemoveDamaged deletes or quarantines an entry listed by Damaged. See the
+// Checker interface.
+func (e *Encrypted) RemoveDamaged(name string, quarantine bool) error {
+	if strings.HasSuffix(name, dataKeySuffix) {
+		if _, err := e.backend.Stat(name); err == nil {
+			if quarantine {
+				return e.quarantineBackend(name)
+			}
+			return e.backend.Delete(name)
+		}
+	}
+	checker, ok := e.backend.(Checker)
+	if !ok {
+		return ErrNotFound
+	}
+	return checker.RemoveDamaged(name, quarantine)
+}
+
+// Quarantine moves the file and its data key aside, if the underlying Backend
+// is a Quarantiner. See the Quarantiner interface.
+func (e *Encrypted) Quarantine(uid string) error {
+	if err := e.quarantineBackend(uid); err != nil {
+		return err
+	}
+	err := e.quarantineBackend(uid + dataKeySuffix)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+func (e *Encrypted) quarantineBackend(uid string) error {
+	quarantiner, ok := e.backend.(Quarantiner)
+	if !ok {
+		return ErrQuarantineUnsupported
+	}
+	return quarantiner.Quarantine(uid)
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func newTestEncrypted(t *testing.T, b Backend, keys ...byte) *Encrypted {
+	masterKeys := make([]MasterKey, len(keys))
+	for i, k := range keys {
+		masterKeys[i][0] = k
+	}
+	e, err := NewEncrypted(b, masterKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// readAll reads the whole file with the given UID.
+func readAll(t *testing.T, b Backend, uid string) []byte {
+	f, _, err := b.Get(uid)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	return data
+}
+
+func TestEncrypted(t *testing.T) {
+	testBackend(t, newTestEncrypted(t, NewMemory(), 1))
+}
+
+func TestEncryptedReplace(t *testing.T) {
+	mem := NewMemory()
+	e := newTestEncrypted(t, mem, 1)
+	data := bytes.Repeat([]byte("webfiles"), encryptedChunkSize/4)
+	const uid = "0123456789abcdef"
+
+	// Storing the same file again, with a new data key, replaces the key
+	// along with the ciphertext.
+	for i := 0; i < 2; i++ {
+		if _, err := e.Put(uid, Metadata{}, bytes.NewReader(data)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if got := readAll(t, e, uid); !bytes.Equal(got, data) {
+			t.Fatalf("read %d bytes after Put %d, expected %d", len(got), i, len(data))
+		}
+	}
+	list, err := mem.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0] != uid {
+		t.Errorf("underlying Backend stores %v, expected only the file", list)
+	}
+	if plain := readAll(t, mem, uid); bytes.Contains(plain, data[:64]) {
+		t.Error("stored file is not encrypted")
+	}
+}
+
+func TestEncryptedRewrap(t *testing.T) {
+	mem := NewMemory()
+	data := []byte("encrypted with the old master key")
+	const uid = "0123456789abcdef"
+	if _, err := newTestEncrypted(t, mem, 1).Put(uid, Metadata{Name: "old.txt"},
+		bytes.NewReader(data)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	n, err := newTestEncrypted(t, mem, 2, 1).Rewrap()
+	if err != nil {
+		t.Fatalf("Rewrap failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Rewrap re-wrapped %d keys, expected 1", n)
+	}
+
+	// The old master key is no longer needed.
+	e := newTestEncrypted(t, mem, 2)
+	if got := readAll(t, e, uid); !bytes.Equal(got, data) {
+		t.Errorf("read %q after Rewrap, expected %q", got, data)
+	}
+	info, err := e.Stat(uid)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Name != "old.txt" || info.Size != int64(len(data)) {
+		t.Errorf("Stat described the file as %+v after Rewrap", info)
+	}
+	if n, err = e.Rewrap(); err != nil || n != 0 {
+		t.Errorf("second Rewrap re-wrapped %d keys: %v", n, err)
+	}
+}
+
+func TestEncryptedLegacyKey(t *testing.T) {
+	mem := NewMemory()
+	e := newTestEncrypted(t, mem, 1)
+	data := []byte("encrypted with a separately stored key")
+	const uid = "0123456789abcdef"
+
+	// Store the file as files were stored before, with no header, no UID
+	// authenticated with the last chunk, and the data key in a separate
+	// record.
+	dataKey := make([]byte, 32)
+	dataKey[0] = 3
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := aead.Seal(nil, chunkNonce(make([]byte, aead.NonceSize()), 0, true), data, nil)
+	if _, err = mem.Put(uid, Metadata{}, bytes.NewReader(ciphertext)); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := e.wrapKey(uid, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.writeKeyRecord(uid, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readAll(t, e, uid); !bytes.Equal(got, data) {
+		t.Errorf("read %q with separate key, expected %q", got, data)
+	}
+
+	// Storing the file again puts the key in the header and deletes the
+	// separate record.
+	if _, err = e.Put(uid, Metadata{}, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if got := readAll(t, e, uid); !bytes.Equal(got, data) {
+		t.Errorf("read %q after Put, expected %q", got, data)
+	}
+	if _, err = mem.Stat(uid + dataKeySuffix); err != ErrNotFound {
+		t.Errorf("separate key record not deleted: %v", err)
+	}
+}
+
+func TestEncryptedCopiedFile(t *testing.T) {
+	mem := NewMemory()
+	e := newTestEncrypted(t, mem, 1)
+	data := bytes.Repeat([]byte("webfiles"), encryptedChunkSize/4)
+	const uid, otherUID = "0123456789abcdef", "fedcba9876543210"
+	if _, err := e.Put(uid, Metadata{}, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// A file copied to another UID in the underlying Backend is refused when
+	// opened, before any of it is read.
+	stored := readAll(t, mem, uid)
+	if _, err := mem.Put(otherUID, Metadata{}, bytes.NewReader(stored)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := e.Get(otherUID); err == nil {
+		t.Error("Get of copied file succeeded")
+	} else if _, ok := err.(*CorruptError); !ok {
+		t.Errorf("Get of copied file returned %v, expected a CorruptError", err)
+	}
+	if got := readAll(t, e, uid); !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes of original file, expected %d", len(got), len(data))
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memFile is a file stored by a Memory Backend.
+type memFile struct {
+	meta    Metadata
+	data    []byte
+	modTime time.Time
+}
+
+// Memory is a Backend that keeps files in memory. It is intended for testing.
+type Memory struct {
+	mtx   sync.RWMutex
+	files map[string]*memFile
+}
+
+// NewMemory creates an empty Memory Backend.
+func NewMemory() *Memory {
+	return &Memory{
+		files: make(map[string]*memFile),
+	}
+}
+
+// memReader adds a no-op Close method to a bytes.Reader.
+type memReader struct {
+	*bytes.Reader
+}
+
+// Close satisfies io.Closer.
+func (memReader) Close() error {
+	return nil
+}
+
+// Put reads all of r into memory. See the Backend interface.
+func (m *Memory) Put(uid string, meta Metadata, r io.Reader) (int64, error) {
+	if !validUID(uid) {
+		return 0, ErrInvalidUID
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.files[uid] = &memFile{
+		meta:    meta,
+		data:    data,
+		modTime: time.Now(),
+	}
+	return int64(len(data)), nil
+}
+
+// Get returns a reader for the in-memory file. See the Backend interface.
+func (m *Memory) Get(uid string) (File, *FileInfo, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	f, ok := m.files[uid]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	return memReader{bytes.NewReader(f.data)}, f.info(uid), nil
+}
+
+// Stat describes the in-memory file. See the Backend interface.
+func (m *Memory) Stat(uid string) (*FileInfo, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	f, ok := m.files[uid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return f.info(uid), nil
+}
+
+// Delete discards the in-memory file. See the Backend interface.
+func (m *Memory) Delete(uid string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.files[uid]; !ok {
+		return ErrNotFound
+	}
+	delete(m.files, uid)
+	return nil
+}
+
+// List returns the sorted UIDs of all in-memory files. See the Backend
+// interface.
+func (m *Memory) List() ([]string, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	uids := make([]string, 0, len(m.files))
+	for uid := range m.files {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+	return uids, nil
+}
+
+func (f *memFile) info(uid string) *FileInfo {
+	return &FileInfo{
+		Metadata: f.meta,
+		UID:      uid,
+		Size:     int64(len(f.data)),
+		ModTime:  f.modTime,
+	}
+}
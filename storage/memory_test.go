@@ -0,0 +1,134 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testBackend checks that b satisfies the Backend contract. b must be empty.
+func testBackend(t *testing.T, b Backend) {
+	meta := Metadata{
+		Name:            "hello world.txt",
+		ContentType:     "text/plain; charset=utf-8",
+		ContentEncoding: "gzip",
+	}
+	const data = "Hello, webfiles!"
+
+	n, err := b.Put("0123456789abcdef", meta, strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("Put stored %d bytes, expected %d", n, len(data))
+	}
+
+	// Get returns the data and metadata, and the File is seekable.
+	f, info, err := b.Get("0123456789abcdef")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(got) != data {
+		t.Errorf("Get read %q, expected %q", got, data)
+	}
+	if _, err = f.Seek(7, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	got, _ = ioutil.ReadAll(f)
+	if string(got) != data[7:] {
+		t.Errorf("read %q after Seek, expected %q", got, data[7:])
+	}
+	f.Close()
+	if info.UID != "0123456789abcdef" || info.Size != int64(len(data)) ||
+		info.Metadata != meta {
+		t.Errorf("Get described the file as %+v", info)
+	}
+	if info.ModTime.IsZero() {
+		t.Errorf("Get returned no ModTime")
+	}
+
+	// Stat agrees with Get.
+	stat, err := b.Stat("0123456789abcdef")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if stat.UID != info.UID || stat.Size != info.Size || stat.Metadata != info.Metadata {
+		t.Errorf("Stat described the file as %+v, Get as %+v", stat, info)
+	}
+
+	// Put replaces an existing file.
+	if _, err = b.Put("0123456789abcdef", Metadata{Name: "b"}, strings.NewReader("new")); err != nil {
+		t.Fatalf("Put failed to replace file: %v", err)
+	}
+	f, info, err = b.Get("0123456789abcdef")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	got, _ = ioutil.ReadAll(f)
+	f.Close()
+	if string(got) != "new" || info.Name != "b" {
+		t.Errorf("replaced file is %q named %q", got, info.Name)
+	}
+
+	// Files written with Stage are stored on Commit, and not on Abort.
+	staged, err := Stage(b)
+	if err != nil {
+		t.Fatalf("Stage failed: %v", err)
+	}
+	io.WriteString(staged, "staged")
+	if err = staged.Commit("fedcba9876543210", Metadata{Name: "s"}); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if stat, err = b.Stat("fedcba9876543210"); err != nil || stat.Size != 6 {
+		t.Errorf("committed file is %+v (%v)", stat, err)
+	}
+	staged, err = Stage(b)
+	if err != nil {
+		t.Fatalf("Stage failed: %v", err)
+	}
+	io.WriteString(staged, "aborted")
+	if err = staged.Abort(); err != nil {
+		t.Errorf("Abort failed: %v", err)
+	}
+
+	uids, err := b.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	sort.Strings(uids)
+	if expected := []string{"0123456789abcdef", "fedcba9876543210"}; !reflect.DeepEqual(uids, expected) {
+		t.Errorf("List returned %v, expected %v", uids, expected)
+	}
+
+	// Deleted files are not found.
+	if err = b.Delete("0123456789abcdef"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, _, err = b.Get("0123456789abcdef"); err != ErrNotFound {
+		t.Errorf("Get of deleted file returned %v, expected ErrNotFound", err)
+	}
+	if _, err = b.Stat("0123456789abcdef"); err != ErrNotFound {
+		t.Errorf("Stat of deleted file returned %v, expected ErrNotFound", err)
+	}
+	if err = b.Delete("0123456789abcdef"); err != ErrNotFound {
+		t.Errorf("Delete of deleted file returned %v, expected ErrNotFound", err)
+	}
+
+	if _, err = b.Put("../escape", meta, strings.NewReader(data)); err != ErrInvalidUID {
+		t.Errorf("Put with invalid UID returned %v, expected ErrInvalidUID", err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testBackend(t, NewMemory())
+}
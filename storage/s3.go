@@ -0,0 +1,220 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+// s3NameMeta is the user metadata key for the original file name. S3 returns
+// user metadata in the X-Amz-Meta-* headers.
+const (
+	s3NameMeta   = "name"
+	s3NameHeader = "X-Amz-Meta-Name"
+)
+
+// S3Config describes the S3-compatible object storage service and bucket used
+// by an S3 Backend.
+type S3Config struct {
+	// Endpoint is the host[:port] of the service (e.g. s3.amazonaws.com or
+	// localhost:9000 for a local MinIO server).
+	Endpoint  string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Region is optional. When empty, the bucket's region is looked up.
+	Region string
+	// Prefix is prepended to each object's key, allowing a bucket to be
+	// shared.
+	Prefix string
+	// Secure enables HTTPS.
+	Secure bool
+}
+
+// S3 is a Backend that stores files as objects in an S3-compatible bucket. The
+// object key is the UID, the original file name is stored in the object's user
+// metadata, and the MIME type and content encoding are the object's
+// Content-Type and Content-Encoding.
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3 creates an S3 Backend for the configured service, creating the bucket
+// if it does not exist.
+func NewS3(cfg *S3Config) (*S3, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("no S3 bucket specified")
+	}
+	client, err := minio.NewWithRegion(cfg.Endpoint, cfg.AccessKey, cfg.SecretKey,
+		cfg.Secure, cfg.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for bucket %s: %v", cfg.Bucket, err)
+	}
+	if !exists {
+		log.Infof("Creating S3 bucket %s.", cfg.Bucket)
+		if err = client.MakeBucket(cfg.Bucket, cfg.Region); err != nil {
+			return nil, fmt.Errorf("failed to create bucket %s: %v", cfg.Bucket, err)
+		}
+	}
+
+	return &S3{
+		client: client,
+		bucket: cfg.Bucket,
+		prefix: cfg.Prefix,
+	}, nil
+}
+
+// key returns the object key for the given UID.
+func (s *S3) key(uid string) (string, error) {
+	if !validUID(uid) {
+		return "", ErrInvalidUID
+	}
+	return s.prefix + uid, nil
+}
+
+// s3Error converts missing object errors to ErrNotFound.
+func s3Error(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return ErrNotFound
+	}
+	return err
+}
+
+// readerSize attempts to determine the number of bytes remaining in r without
+// reading it. -1 is returned if the size is unknown.
+func readerSize(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case *os.File:
+		stat, err := v.Stat()
+		if err != nil || !stat.Mode().IsRegular() {
+			return -1
+		}
+		pos, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return stat.Size() - pos
+	}
+	return -1
+}
+
+// Put uploads the data read from r as an object. See the Backend interface.
+func (s *S3) Put(uid string, meta Metadata, r io.Reader) (int64, error) {
+	key, err := s.key(uid)
+	if err != nil {
+		return 0, err
+	}
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	opts := minio.PutObjectOptions{
+		ContentType:     contentType,
+		ContentEncoding: meta.ContentEncoding,
+		UserMetadata: map[string]string{
+			// Header values must be ASCII.
+			s3NameMeta: url.QueryEscape(meta.Name),
+		},
+	}
+	return s.client.PutObject(s.bucket, key, r, readerSize(r), opts)
+}
+
+// Get opens the object for reading. The returned File issues ranged GET
+// requests as needed when seeking. See the Backend interface.
+func (s *S3) Get(uid string) (File, *FileInfo, error) {
+	key, err := s.key(uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	obj, err := s.client.GetObject(s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, s3Error(err)
+	}
+	// GetObject is lazy, so Stat to verify the object exists.
+	objInfo, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, nil, s3Error(err)
+	}
+	return obj, s.fileInfo(uid, &objInfo), nil
+}
+
+// Stat describes the object. See the Backend interface.
+func (s *S3) Stat(uid string) (*FileInfo, error) {
+	key, err := s.key(uid)
+	if err != nil {
+		return nil, err
+	}
+	objInfo, err := s.client.StatObject(s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return s.fileInfo(uid, &objInfo), nil
+}
+
+// Delete removes the object. See the Backend interface.
+func (s *S3) Delete(uid string) error {
+	key, err := s.key(uid)
+	if err != nil {
+		return err
+	}
+	// RemoveObject succeeds for missing objects, so check first.
+	if _, err = s.client.StatObject(s.bucket, key, minio.StatObjectOptions{}); err != nil {
+		return s3Error(err)
+	}
+	return s.client.RemoveObject(s.bucket, key)
+}
+
+// List returns the UIDs of all objects with the configured key prefix. See the
+// Backend interface.
+func (s *S3) List() ([]string, error) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	var uids []string
+	for objInfo := range s.client.ListObjectsV2(s.bucket, s.prefix, true, doneCh) {
+		if objInfo.Err != nil {
+			return nil, objInfo.Err
+		}
+		uid := strings.TrimPrefix(objInfo.Key, s.prefix)
+		if validUID(uid) {
+			uids = append(uids, uid)
+		}
+	}
+	return uids, nil
+}
+
+// fileInfo describes the stored file from the object's attributes.
+func (s *S3) fileInfo(uid string, objInfo *minio.ObjectInfo) *FileInfo {
+	name, err := url.QueryUnescape(objInfo.Metadata.Get(s3NameHeader))
+	if err != nil || name == "" {
+		name = uid
+	}
+	return &FileInfo{
+		Metadata: Metadata{
+			Name:            name,
+			ContentType:     objInfo.ContentType,
+			ContentEncoding: objInfo.Metadata.Get("Content-Encoding"),
+		},
+		UID:     uid,
+		Size:    objInfo.Size,
+		ModTime: objInfo.LastModified,
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+package storage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeObject is an object stored by fakeS3.
+type fakeObject struct {
+	data    []byte
+	header  http.Header
+	modTime time.Time
+}
+
+// fakeS3 is an http.Handler implementing the subset of the S3 API used by the
+// S3 Backend, with path-style bucket addressing and no authentication.
+type fakeS3 struct {
+	mtx     sync.Mutex
+	buckets map[string]map[string]*fakeObject
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{buckets: make(map[string]map[string]*fakeObject)}
+}
+
+// listBucketResult is the ListObjectsV2 response.
+type listBucketResult struct {
+	XMLName     xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	MaxKeys     int
+	IsTruncated bool
+	Contents    []listBucketObject
+}
+
+type listBucketObject struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, ok := f.buckets[path[0]]
+	if len(path) == 1 || path[1] == "" {
+		switch {
+		case r.Method == http.MethodPut:
+			f.buckets[path[0]] = make(map[string]*fakeObject)
+		case !ok:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+			f.list(w, path[0], bucket, r.URL.Query().Get("prefix"))
+		}
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	key := path[1]
+	obj := bucket[key]
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		header := make(http.Header)
+		for k, v := range r.Header {
+			if k == "Content-Type" || k == "Content-Encoding" ||
+				strings.HasPrefix(k, "X-Amz-Meta-") {
+				header[k] = v
+			}
+		}
+		header.Set("ETag", `"`+strconv.Itoa(len(data))+`"`)
+		bucket[key] = &fakeObject{
+			data:    data,
+			header:  header,
+			modTime: time.Now().Truncate(time.Second),
+		}
+		w.Header().Set("ETag", header.Get("ETag"))
+	case http.MethodHead, http.MethodGet:
+		if obj == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for k, v := range obj.header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+		// Only the open-ended ranges requested when seeking are supported.
+		data, status := obj.data, http.StatusOK
+		if rng := r.Header.Get("Range"); strings.HasPrefix(rng, "bytes=") {
+			start, err := strconv.Atoi(strings.TrimSuffix(rng[6:], "-"))
+			if err != nil || start >= len(data) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start,
+				len(data)-1, len(data)))
+			data, status = data[start:], http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, name string, bucket map[string]*fakeObject,
+	prefix string) {
+	result := listBucketResult{Name: name, Prefix: prefix, MaxKeys: 1000}
+	for key, obj := range bucket {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		result.Contents = append(result.Contents, listBucketObject{
+			Key:          key,
+			LastModified: obj.modTime.UTC().Format(time.RFC3339),
+			ETag:         obj.header.Get("ETag"),
+			Size:         int64(len(obj.data)),
+		})
+	}
+	sort.Slice(result.Contents, func(i, j int) bool {
+		return result.Contents[i].Key < result.Contents[j].Key
+	})
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(&result)
+}
+
+func TestS3(t *testing.T) {
+	fake := newFakeS3()
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	endpoint, _ := url.Parse(ts.URL)
+
+	s3, err := NewS3(&S3Config{
+		Endpoint: endpoint.Host,
+		Bucket:   "webfiles",
+		Region:   "us-east-1",
+		Prefix:   "uploads/",
+	})
+	if err != nil {
+		t.Fatalf("NewS3 failed: %v", err)
+	}
+	if _, ok := fake.buckets["webfiles"]; !ok {
+		t.Fatalf("NewS3 did not create the bucket")
+	}
+	// Objects outside the prefix are not listed.
+	fake.buckets["webfiles"]["other/0000000000000001"] = &fakeObject{header: http.Header{}}
+
+	testBackend(t, s3)
+}
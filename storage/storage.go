@@ -0,0 +1,179 @@
+// Copyright (c) 2018 Jonathan Chappelow
+// See LICENSE for details.
+
+// Package storage defines the Backend interface used by webfiles to store
+// uploaded file data, along with disk and in-memory implementations.
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.New()
+
+// UseLog sets an external logger for use by this package.
+func UseLog(_log *logrus.Logger) {
+	log = _log
+}
+
+var (
+	// ErrNotFound is returned when a file with the requested UID does not
+	// exist in the Backend.
+	ErrNotFound = errors.New("file not found")
+
+	// ErrInvalidUID is returned when a UID is not usable as a storage key.
+	ErrInvalidUID = errors.New("invalid file UID")
+
+	// ErrQuarantineUnsupported is returned by a Quarantiner that wraps a
+	// Backend that cannot quarantine files.
+	ErrQuarantineUnsupported = errors.New("quarantine not supported by storage")
+)
+
+// CorruptError is returned when stored data fails an integrity check, such as a
+// chunk that does not match its hash or ciphertext that fails authentication,
+// or when stored metadata such as a manifest or data key record is invalid.
+// Unlike other errors reading a file, it is not resolved by trying again.
+type CorruptError struct {
+	Detail string
+}
+
+func (e *CorruptError) Error() string {
+	return e.Detail
+}
+
+// Metadata describes the attributes of a stored file that are not derived from
+// the file's contents.
+type Metadata struct {
+	// Name is the original file name provided by the uploader.
+	Name string
+	// ContentType is the MIME type of the file, which may be empty if it is
+	// unknown.
+	ContentType string
+	// ContentEncoding is the encoding of the stored data, such as "gzip" if
+	// it is compressed, or empty if it is stored as uploaded.
+	ContentEncoding string
+}
+
+// FileInfo describes a stored file.
+type FileInfo struct {
+	Metadata
+	UID     string
+	Size    int64
+	ModTime time.Time
+}
+
+// File is a stored file opened for reading.
+type File interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Backend is implemented by file storage systems. Files are identified by UID.
+type Backend interface {
+	// Put stores the data read from r with the given UID and metadata,
+	// replacing any existing file with the same UID. The number of bytes
+	// stored is returned.
+	Put(uid string, meta Metadata, r io.Reader) (int64, error)
+	// Get opens the file with the given UID for reading. The caller must
+	// Close the returned File.
+	Get(uid string) (File, *FileInfo, error)
+	// Stat describes the file with the given UID without opening it.
+	Stat(uid string) (*FileInfo, error)
+	// Delete removes the file with the given UID.
+	Delete(uid string) error
+	// List returns the UIDs of all stored files.
+	List() ([]string, error)
+}
+
+// validUID checks that uid is non-empty and contains only characters that are
+// safe to use as a path element or object key.
+func validUID(uid string) bool {
+	if uid == "" {
+		return false
+	}
+	for _, c := range uid {
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z',
+			c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Checker is implemented by Backends that can find stored data that is not a
+// usable file, such as an incomplete or damaged file, or an abandoned upload.
+type Checker interface {
+	// Damaged lists the names of the unusable entries.
+	Damaged() ([]string, error)
+	// RemoveDamaged deletes an entry listed by Damaged, or moves it to
+	// quarantine.
+	RemoveDamaged(name string, quarantine bool) error
+}
+
+// Quarantiner is implemented by Backends that can move a stored file aside, so
+// that it is no longer listed or served, but is kept for inspection.
+type Quarantiner interface {
+	Quarantine(uid string) error
+}
+
+// Staged is a file being written to a Backend before its UID is known, such as
+// when the UID is computed from the file's contents as it is written.
+type Staged interface {
+	io.Writer
+	// Commit stores the written data with the given UID and metadata,
+	// replacing any existing file with the same UID.
+	Commit(uid string, meta Metadata) error
+	// Abort discards the written data.
+	Abort() error
+}
+
+// Stager is implemented by Backends that can write a file before its UID is
+// known, and move it into place efficiently once it is.
+type Stager interface {
+	Stage() (Staged, error)
+}
+
+// Stage begins writing a file to the Backend. If b is not a Stager, the data is
+// written to a local temporary file, and the Backend's Put method is used when
+// the Staged file is committed.
+func Stage(b Backend) (Staged, error) {
+	if stager, ok := b.(Stager); ok {
+		return stager.Stage()
+	}
+	tmp, err := ioutil.TempFile("", "webfiles-upload-")
+	if err != nil {
+		return nil, err
+	}
+	return &tempStaged{File: tmp, backend: b}, nil
+}
+
+// tempStaged is a Staged file for a Backend that does not implement Stager.
+type tempStaged struct {
+	*os.File
+	backend Backend
+}
+
+// Commit copies the temporary file to the Backend with Put. See the Staged
+// interface.
+func (t *tempStaged) Commit(uid string, meta Metadata) error {
+	defer t.Abort()
+	if _, err := t.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := t.backend.Put(uid, meta, t.File)
+	return err
+}
+
+// Abort closes and removes the temporary file. See the Staged interface.
+func (t *tempStaged) Abort() error {
+	t.Close()
+	return os.Remove(t.Name())
+}